@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type aggFunc int
+
+const (
+	aggCount aggFunc = iota
+	aggSum
+	aggMin
+	aggMax
+	aggMean
+	aggDistinct
+)
+
+func (f aggFunc) String() string {
+	switch f {
+	case aggCount:
+		return "count"
+	case aggSum:
+		return "sum"
+	case aggMin:
+		return "min"
+	case aggMax:
+		return "max"
+	case aggMean:
+		return "mean"
+	case aggDistinct:
+		return "distinct"
+	}
+	return "agg(" + strconv.Itoa(int(f)) + ")"
+}
+
+// aggSpec is one aggregate over column Col. Col is ignored by aggCount, which
+// counts rows. sum, min, max and mean skip values that aren't numbers.
+type aggSpec struct {
+	Func aggFunc
+	Col  int
+}
+
+type aggregateOptions struct {
+	GroupBy []int
+	Aggs    []aggSpec
+
+	// Workers is how many partial aggregations run in parallel before being
+	// merged. Defaults to the number of CPUs.
+	Workers int
+}
+
+type aggState struct {
+	rows     int64
+	numbers  int64
+	sum      float64
+	min, max float64
+	distinct map[string]struct{}
+}
+
+func (s *aggState) add(spec aggSpec, record []string) {
+	s.rows++
+
+	if spec.Func == aggDistinct {
+		if s.distinct == nil {
+			s.distinct = make(map[string]struct{})
+		}
+		s.distinct[record[spec.Col]] = struct{}{}
+		return
+	}
+	if spec.Func == aggCount {
+		return
+	}
+
+	v, err := strconv.ParseFloat(record[spec.Col], 64)
+	if err != nil {
+		return
+	}
+	if s.numbers == 0 {
+		s.min, s.max = v, v
+	}
+	s.numbers++
+	s.sum += v
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+}
+
+func (s *aggState) merge(o *aggState) {
+	s.rows += o.rows
+	if o.numbers > 0 {
+		if s.numbers == 0 {
+			s.min, s.max = o.min, o.max
+		}
+		s.min = math.Min(s.min, o.min)
+		s.max = math.Max(s.max, o.max)
+	}
+	s.numbers += o.numbers
+	s.sum += o.sum
+
+	if o.distinct != nil {
+		if s.distinct == nil {
+			s.distinct = make(map[string]struct{}, len(o.distinct))
+		}
+		for k := range o.distinct {
+			s.distinct[k] = struct{}{}
+		}
+	}
+}
+
+// value formats the aggregate. Numeric aggregates over no numbers are empty.
+func (s *aggState) value(f aggFunc) string {
+	format := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	switch f {
+	case aggCount:
+		return strconv.FormatInt(s.rows, 10)
+	case aggDistinct:
+		return strconv.Itoa(len(s.distinct))
+	}
+
+	if s.numbers == 0 {
+		return ""
+	}
+	switch f {
+	case aggSum:
+		return format(s.sum)
+	case aggMin:
+		return format(s.min)
+	case aggMax:
+		return format(s.max)
+	case aggMean:
+		return format(s.sum / float64(s.numbers))
+	}
+	return ""
+}
+
+type aggGroup struct {
+	key    []string
+	states []aggState
+}
+
+// aggTable is the running aggregation of one set of records. Tables built
+// from different parts of a stream can be merged.
+type aggTable struct {
+	groupBy []int
+	specs   []aggSpec
+	key     func([]string) string
+	groups  map[string]*aggGroup
+}
+
+func newAggTable(groupBy []int, specs []aggSpec) *aggTable {
+	key := func([]string) string { return "" }
+	if len(groupBy) > 0 {
+		key = columnKey(groupBy...)
+	}
+	return &aggTable{
+		groupBy: groupBy,
+		specs:   specs,
+		key:     key,
+		groups:  make(map[string]*aggGroup),
+	}
+}
+
+func (t *aggTable) add(record []string) {
+	k := t.key(record)
+	g, ok := t.groups[k]
+	if !ok {
+		g = &aggGroup{states: make([]aggState, len(t.specs))}
+		for _, col := range t.groupBy {
+			g.key = append(g.key, record[col])
+		}
+		t.groups[k] = g
+	}
+	for i, spec := range t.specs {
+		g.states[i].add(spec, record)
+	}
+}
+
+func (t *aggTable) merge(o *aggTable) {
+	for k, og := range o.groups {
+		g, ok := t.groups[k]
+		if !ok {
+			t.groups[k] = og
+			continue
+		}
+		for i := range g.states {
+			g.states[i].merge(&og.states[i])
+		}
+	}
+}
+
+// records returns one record per group, sorted by group key: the group
+// columns followed by each aggregate.
+func (t *aggTable) records() [][]string {
+	keys := make([]string, 0, len(t.groups))
+	for k := range t.groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	records := make([][]string, 0, len(keys))
+	for _, k := range keys {
+		g := t.groups[k]
+		record := append([]string{}, g.key...)
+		for i, spec := range t.specs {
+			record = append(record, g.states[i].value(spec.Func))
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// aggregate groups the records of in by opts.GroupBy and computes opts.Aggs
+// for each group. Several workers each aggregate part of the stream and their
+// tables are merged once in is closed, then one record per group is sent.
+func aggregate(ctx context.Context, in <-chan []string, opts aggregateOptions) <-chan []string {
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	out := make(chan []string)
+
+	go func() {
+		defer close(out)
+
+		tables := make([]*aggTable, workers)
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for i := range tables {
+			tables[i] = newAggTable(opts.GroupBy, opts.Aggs)
+			go func(t *aggTable) {
+				defer wg.Done()
+				for {
+					select {
+					case record, ok := <-in:
+						if !ok {
+							return
+						}
+						t.add(record)
+					case <-ctx.Done():
+						return
+					}
+				}
+			}(tables[i])
+		}
+		wg.Wait()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		for _, t := range tables[1:] {
+			tables[0].merge(t)
+		}
+
+		for _, record := range tables[0].records() {
+			select {
+			case out <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// aggregateExample counts the rows of combo.csv per last column, with the
+// number of distinct first words and the longest second word.
+func aggregateExample() {
+	ch, err := read("combo.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	withLength := make(chan []string)
+	go func() {
+		defer close(withLength)
+		for record := range ch {
+			withLength <- append(record, strconv.Itoa(len(record[1])))
+		}
+	}()
+
+	aggregated := aggregate(context.Background(), withLength, aggregateOptions{
+		GroupBy: []int{3},
+		Aggs: []aggSpec{
+			{Func: aggCount},
+			{Func: aggDistinct, Col: 0},
+			{Func: aggMax, Col: 4},
+		},
+	})
+	for v := range aggregated {
+		fmt.Println(v)
+	}
+}
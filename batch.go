@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A batched pipeline moves slices of items between stages instead of single
+// items, so the cost of a channel send and receive is shared by the whole
+// slice. Stages are still written per item: batchedPipeline takes plain
+// functions of one item, like the ones multiply and add apply, and does the
+// batching and unbatching itself, so callers send and receive single items
+// as with any other stage. mapBatches and filterBatches are the same steps
+// for pipelines that pass batches on to further batched stages.
+//
+// A batch belongs to the stage that receives it, like records do (see
+// record_pool.go).
+
+// batchItems groups the items of in into batches of up to size. Once a
+// batch has its first item it is sent when it is full, when in is closed,
+// or when linger has passed since that first item, so a slow producer only
+// holds items back for linger. A linger of 0 or less sends whatever in has
+// ready without waiting. A size below 1 is taken as 1.
+func batchItems[T any](done <-chan interface{}, in <-chan T, size int, linger time.Duration) <-chan []T {
+	if size < 1 {
+		size = 1
+	}
+	out := make(chan []T)
+
+	go func() {
+		defer close(out)
+
+		timer := time.NewTimer(time.Hour)
+		timer.Stop()
+		defer timer.Stop()
+
+		for {
+			// Batches grow as items arrive, so one that is sent early
+			// doesn't cost a whole size's worth of memory.
+			var batch []T
+			select {
+			case v, ok := <-in:
+				if !ok {
+					return
+				}
+				batch = append(batch, v)
+			case <-done:
+				return
+			}
+
+			open := true
+			if linger > 0 && len(batch) < size {
+				timer.Reset(linger)
+				expired := false
+			wait:
+				for len(batch) < size {
+					select {
+					case v, ok := <-in:
+						if !ok {
+							open = false
+							break wait
+						}
+						batch = append(batch, v)
+					case <-timer.C:
+						expired = true
+						break wait
+					case <-done:
+						return
+					}
+				}
+				if !expired && !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+			}
+
+		ready:
+			for open && len(batch) < size {
+				select {
+				case v, ok := <-in:
+					if !ok {
+						open = false
+						break ready
+					}
+					batch = append(batch, v)
+				default:
+					break ready
+				}
+			}
+
+			select {
+			case out <- batch:
+			case <-done:
+				return
+			}
+			if !open {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// unbatch sends the items of each batch of in one at a time.
+func unbatch[T any](done <-chan interface{}, in <-chan []T) <-chan T {
+	out := make(chan T)
+
+	go func() {
+		defer close(out)
+		for batch := range in {
+			for _, v := range batch {
+				select {
+				case out <- v:
+				case <-done:
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// generateBatches is generator for batched pipelines. A size below 1 is
+// taken as 1, as in batchItems.
+func generateBatches[T any](done <-chan interface{}, size int, items ...T) <-chan []T {
+	if size < 1 {
+		size = 1
+	}
+	out := make(chan []T)
+
+	go func() {
+		defer close(out)
+		for len(items) > 0 {
+			n := size
+			if n > len(items) {
+				n = len(items)
+			}
+			batch := append([]T(nil), items[:n]...)
+			items = items[n:]
+
+			select {
+			case out <- batch:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// mapBatches applies fn to every item. When In and Out are the same type
+// the batch is rewritten in place, which the stage may do as it owns it.
+func mapBatches[In, Out any](done <-chan interface{}, in <-chan []In, fn func(In) Out) <-chan []Out {
+	out := make(chan []Out)
+
+	go func() {
+		defer close(out)
+		for batch := range in {
+			var result []Out
+			if same, ok := any(batch).([]Out); ok {
+				result = same
+				for i, v := range batch {
+					result[i] = fn(v)
+				}
+			} else {
+				result = make([]Out, len(batch))
+				for i, v := range batch {
+					result[i] = fn(v)
+				}
+			}
+
+			select {
+			case out <- result:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// filterBatches keeps the items keep returns true for. Batches left empty
+// are not sent.
+func filterBatches[T any](done <-chan interface{}, in <-chan []T, keep func(T) bool) <-chan []T {
+	out := make(chan []T)
+
+	go func() {
+		defer close(out)
+		for batch := range in {
+			kept := batch[:0]
+			for _, v := range batch {
+				if keep(v) {
+					kept = append(kept, v)
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+
+			select {
+			case out <- kept:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// batchStep is one per-item step of batchedPipeline. It returns the item to
+// pass on, or false to drop it.
+type batchStep[T any] func(T) (T, bool)
+
+// mapStep makes a step that replaces each item with fn's result.
+func mapStep[T any](fn func(T) T) batchStep[T] {
+	return func(v T) (T, bool) { return fn(v), true }
+}
+
+// filterStep makes a step that drops the items keep returns false for.
+func filterStep[T any](keep func(T) bool) batchStep[T] {
+	return func(v T) (T, bool) { return v, keep(v) }
+}
+
+// stepBatches runs step over every item of each batch in place. Batches left
+// empty are not sent.
+func stepBatches[T any](done <-chan interface{}, in <-chan []T, step batchStep[T]) <-chan []T {
+	out := make(chan []T)
+
+	go func() {
+		defer close(out)
+		for batch := range in {
+			kept := batch[:0]
+			for _, v := range batch {
+				if v, ok := step(v); ok {
+					kept = append(kept, v)
+				}
+			}
+			if len(kept) == 0 {
+				continue
+			}
+
+			select {
+			case out <- kept:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// batchedPipeline runs the items of in through steps, each in its own
+// goroutine like a channel stage, and sends the results one at a time.
+// Between the steps items travel in batches made by batchItems with size and
+// linger, which is where the saving is; the order of items is kept.
+func batchedPipeline[T any](done <-chan interface{}, in <-chan T, size int, linger time.Duration, steps ...batchStep[T]) <-chan T {
+	batches := batchItems(done, in, size, linger)
+	for _, step := range steps {
+		batches = stepBatches(done, batches, step)
+	}
+	return unbatch(done, batches)
+}
+
+func multiplyBatched(done <-chan interface{}, in <-chan []int, multiplier int) <-chan []int {
+	return mapBatches(done, in, func(i int) int { return i * multiplier })
+}
+
+func addBatched(done <-chan interface{}, in <-chan []int, additive int) <-chan []int {
+	return mapBatches(done, in, func(i int) int { return i + additive })
+}
+
+// batchPipeline is pipeline with batches of 4.
+func batchPipeline() {
+	done := make(chan interface{})
+	defer close(done)
+
+	batches := generateBatches(done, 4, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20)
+	pipeline := multiplyBatched(done, addBatched(done, multiplyBatched(done, batches, 2), 1), 2)
+
+	for v := range unbatch(done, pipeline) {
+		fmt.Println(v)
+	}
+}
+
+// batchedPipelineExample is pipeline's multiply, add, multiply written per
+// item, run with batches of up to 4.
+func batchedPipelineExample() {
+	done := make(chan interface{})
+	defer close(done)
+
+	steps := []batchStep[int]{
+		mapStep(func(i int) int { return i * 2 }),
+		mapStep(func(i int) int { return i + 1 }),
+		mapStep(func(i int) int { return i * 2 }),
+	}
+	for v := range batchedPipeline(done, generator(done, 1, 2, 3, 4, 5, 6, 7, 8, 9, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20), 4, time.Millisecond, steps...) {
+		fmt.Println(v)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// benchSource sends 0 to n-1.
+func benchSource(done <-chan interface{}, n int) <-chan int {
+	out := make(chan int)
+	go func() {
+		defer close(out)
+		for i := 0; i < n; i++ {
+			select {
+			case out <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func batchSizes(batches <-chan []int) []int {
+	var sizes []int
+	for batch := range batches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+func TestBatchItemsFills(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	// The source is unbuffered, so items only ever arrive one at a time;
+	// batches must still fill up rather than go out with what is ready.
+	sizes := batchSizes(batchItems(done, benchSource(done, 1000), 64, time.Second))
+
+	want := make([]int, 0, 16)
+	for i := 0; i < 1000/64; i++ {
+		want = append(want, 64)
+	}
+	want = append(want, 1000%64)
+	if !reflect.DeepEqual(sizes, want) {
+		t.Fatalf("batch sizes %v, want %v", sizes, want)
+	}
+}
+
+func TestBatchItemsLinger(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	in := make(chan int)
+	release := make(chan struct{})
+	go func() {
+		defer close(in)
+		for i := 0; i < 3; i++ {
+			in <- i
+		}
+		<-release
+		in <- 3
+	}()
+
+	batches := batchItems(done, in, 64, 10*time.Millisecond)
+	select {
+	case batch := <-batches:
+		if !reflect.DeepEqual(batch, []int{0, 1, 2}) {
+			t.Fatalf("first batch %v, want [0 1 2]", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a partial batch was held back past its linger")
+	}
+
+	close(release)
+	if batch := <-batches; !reflect.DeepEqual(batch, []int{3}) {
+		t.Fatalf("second batch %v, want [3]", batch)
+	}
+	if _, ok := <-batches; ok {
+		t.Fatal("batches not closed after in")
+	}
+}
+
+func TestBatchSizeBelowOne(t *testing.T) {
+	done := make(chan interface{})
+	defer close(done)
+
+	for _, size := range []int{0, -1} {
+		if sizes := batchSizes(batchItems(done, benchSource(done, 3), size, time.Second)); !reflect.DeepEqual(sizes, []int{1, 1, 1}) {
+			t.Fatalf("batchItems size %d: batch sizes %v, want [1 1 1]", size, sizes)
+		}
+		if sizes := batchSizes(generateBatches(done, size, 1, 2, 3)); !reflect.DeepEqual(sizes, []int{1, 1, 1}) {
+			t.Fatalf("generateBatches size %d: batch sizes %v, want [1 1 1]", size, sizes)
+		}
+	}
+}
+
+func TestBatchedPipeline(t *testing.T) {
+	const n = 1000
+	double := func(i int) int { return i * 2 }
+	odd := func(i int) bool { return i%2 == 1 }
+
+	for _, size := range []int{1, 3, 64, 4096} {
+		t.Run(fmt.Sprintf("size=%d", size), func(t *testing.T) {
+			done := make(chan interface{})
+			defer close(done)
+
+			var want []int
+			for v := range add(done, multiply(done, benchSource(done, n), 3), 1) {
+				if odd(v) {
+					want = append(want, double(v))
+				}
+			}
+
+			var got []int
+			steps := []batchStep[int]{
+				mapStep(func(i int) int { return i * 3 }),
+				mapStep(func(i int) int { return i + 1 }),
+				filterStep(odd),
+				mapStep(double),
+			}
+			for v := range batchedPipeline(done, benchSource(done, n), size, time.Millisecond, steps...) {
+				got = append(got, v)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %d items %v..., want %d items %v...", len(got), head(got), len(want), head(want))
+			}
+		})
+	}
+}
+
+func head(s []int) []int {
+	if len(s) > 5 {
+		return s[:5]
+	}
+	return s
+}
+
+// BenchmarkPipelineUnbatched is the multiply, add, multiply pipeline with an
+// item per send.
+func BenchmarkPipelineUnbatched(b *testing.B) {
+	b.ReportAllocs()
+	done := make(chan interface{})
+	defer close(done)
+
+	n := 0
+	for range multiply(done, add(done, multiply(done, benchSource(done, b.N), 2), 1), 2) {
+		n++
+	}
+	if n != b.N {
+		b.Fatalf("got %d items, want %d", n, b.N)
+	}
+}
+
+// BenchmarkPipelineBatched is the same pipeline through batchedPipeline, so
+// the cost of batching and unbatching at its edges is counted too.
+func BenchmarkPipelineBatched(b *testing.B) {
+	steps := []batchStep[int]{
+		mapStep(func(i int) int { return i * 2 }),
+		mapStep(func(i int) int { return i + 1 }),
+		mapStep(func(i int) int { return i * 2 }),
+	}
+
+	for _, size := range []int{1, 8, 64, 512, 4096} {
+		size := size
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			done := make(chan interface{})
+			defer close(done)
+
+			n := 0
+			for range batchedPipeline(done, benchSource(done, b.N), size, time.Millisecond, steps...) {
+				n++
+			}
+			if n != b.N {
+				b.Fatalf("got %d items, want %d", n, b.N)
+			}
+		})
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Topics are dot separated, e.g. "csv.file1". Subscription patterns may use
+// "*" to match exactly one segment and a trailing ">" to match one or more
+// remaining segments, so "csv.*" matches "csv.file1" and "csv.>" also matches
+// "csv.file1.rejected".
+
+var (
+	ErrInvalidTopic   = errors.New("invalid topic")
+	ErrInvalidPattern = errors.New("invalid subscription pattern")
+)
+
+type Message struct {
+	Topic   string
+	Payload interface{}
+}
+
+// OverflowPolicy decides what happens when a message arrives for a
+// subscriber whose buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock makes Publish wait until the subscriber has room, or its
+	// context is done.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the incoming message.
+	OverflowDropNewest
+	// OverflowDropOldest discards the oldest buffered message to make room.
+	OverflowDropOldest
+)
+
+type subscribeOptions struct {
+	buffer   int
+	overflow OverflowPolicy
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+// WithBuffer sets how many messages may be queued for a subscriber that is
+// not keeping up. The default is 16.
+func WithBuffer(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		if n < 1 {
+			n = 1
+		}
+		o.buffer = n
+	}
+}
+
+// WithOverflow sets the policy used once the subscriber's buffer is full. The
+// default is OverflowBlock.
+func WithOverflow(p OverflowPolicy) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.overflow = p
+	}
+}
+
+// Broker is an in-process publish/subscribe hub. Unlike tee and merge it
+// routes by topic, so publishers and subscribers only need to agree on names.
+type Broker struct {
+	mu       sync.RWMutex
+	subs     map[*subscriber]struct{}
+	retained map[string]Message
+
+	dropped uint64
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		subs:     make(map[*subscriber]struct{}),
+		retained: make(map[string]Message),
+	}
+}
+
+type subscriber struct {
+	pattern []string
+	opts    subscribeOptions
+	ctx     context.Context
+
+	cond   *CtxCond
+	queue  []Message
+	closed bool
+}
+
+// Publish sends payload to every subscriber whose pattern matches topic.
+func (b *Broker) Publish(topic string, payload interface{}) error {
+	return b.publish(topic, payload, false)
+}
+
+// PublishRetained is Publish that also keeps the message as the topic's
+// retained message. Every later subscriber whose pattern matches the topic
+// receives it first, before any live message.
+func (b *Broker) PublishRetained(topic string, payload interface{}) error {
+	return b.publish(topic, payload, true)
+}
+
+// ClearRetained forgets the retained message for topic, if any.
+func (b *Broker) ClearRetained(topic string) {
+	b.mu.Lock()
+	delete(b.retained, topic)
+	b.mu.Unlock()
+}
+
+// Dropped returns how many messages were discarded by overflow policies.
+func (b *Broker) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+func (b *Broker) publish(topic string, payload interface{}, retain bool) error {
+	segments, err := splitTopic(topic)
+	if err != nil {
+		return err
+	}
+	msg := Message{Topic: topic, Payload: payload}
+
+	var matched []*subscriber
+	snapshot := func() {
+		for s := range b.subs {
+			if matchTopic(s.pattern, segments) {
+				matched = append(matched, s)
+			}
+		}
+	}
+
+	// Storing the retained message and choosing the recipients happen in the
+	// same critical section, so a concurrent subscriber receives the message
+	// exactly once: either as retained or as live.
+	if retain {
+		b.mu.Lock()
+		b.retained[topic] = msg
+		snapshot()
+		b.mu.Unlock()
+	} else {
+		b.mu.RLock()
+		snapshot()
+		b.mu.RUnlock()
+	}
+
+	for _, s := range matched {
+		s.deliver(msg, &b.dropped)
+	}
+	return nil
+}
+
+// Subscribe returns a channel of every message published on a topic matching
+// pattern. The subscription ends, and the channel is closed, when ctx is done.
+func (b *Broker) Subscribe(ctx context.Context, pattern string, opts ...SubscribeOption) (<-chan Message, error) {
+	segments, err := splitPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	o := subscribeOptions{buffer: 16, overflow: OverflowBlock}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	s := &subscriber{
+		pattern: segments,
+		opts:    o,
+		ctx:     ctx,
+		cond:    NewCtxCond(&sync.Mutex{}),
+	}
+
+	b.mu.Lock()
+	for topic, msg := range b.retained {
+		if matchTopic(segments, strings.Split(topic, ".")) {
+			// Retained messages are queued regardless of the buffer size,
+			// there is nobody reading yet that could make room.
+			s.queue = append(s.queue, msg)
+		}
+	}
+	b.subs[s] = struct{}{}
+	b.mu.Unlock()
+
+	out := make(chan Message)
+	go func() {
+		defer close(out)
+		defer func() {
+			b.mu.Lock()
+			delete(b.subs, s)
+			b.mu.Unlock()
+		}()
+
+		for {
+			msg, ok := s.next()
+			if !ok {
+				return
+			}
+			select {
+			case out <- msg:
+			case <-ctx.Done():
+				s.close()
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+func (s *subscriber) deliver(msg Message, dropped *uint64) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if len(s.queue) >= s.opts.buffer {
+		switch s.opts.overflow {
+		case OverflowDropNewest:
+			atomic.AddUint64(dropped, 1)
+			return
+		case OverflowDropOldest:
+			s.queue = s.queue[1:]
+			atomic.AddUint64(dropped, 1)
+		default:
+			err := s.cond.WaitFor(s.ctx, func() bool {
+				return s.closed || len(s.queue) < s.opts.buffer
+			})
+			if err != nil || s.closed {
+				return
+			}
+		}
+	}
+
+	s.queue = append(s.queue, msg)
+	s.cond.Broadcast()
+}
+
+// next blocks until a message is queued and takes it off the queue. It
+// reports false once the subscriber's context is done.
+func (s *subscriber) next() (Message, bool) {
+	s.cond.L.Lock()
+	defer s.cond.L.Unlock()
+
+	err := s.cond.WaitFor(s.ctx, func() bool {
+		return len(s.queue) > 0
+	})
+	if err != nil {
+		s.closed = true
+		s.queue = nil
+		s.cond.Broadcast()
+		return Message{}, false
+	}
+
+	msg := s.queue[0]
+	s.queue = s.queue[1:]
+	s.cond.Broadcast()
+	return msg, true
+}
+
+func (s *subscriber) close() {
+	s.cond.L.Lock()
+	s.closed = true
+	s.queue = nil
+	s.cond.Broadcast()
+	s.cond.L.Unlock()
+}
+
+func splitTopic(topic string) ([]string, error) {
+	segments := strings.Split(topic, ".")
+	for _, seg := range segments {
+		if seg == "" || seg == "*" || seg == ">" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidTopic, topic)
+		}
+	}
+	return segments, nil
+}
+
+func splitPattern(pattern string) ([]string, error) {
+	segments := strings.Split(pattern, ".")
+	for i, seg := range segments {
+		if seg == "" || (seg == ">" && i != len(segments)-1) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidPattern, pattern)
+		}
+	}
+	return segments, nil
+}
+
+func matchTopic(pattern, topic []string) bool {
+	for i, p := range pattern {
+		if p == ">" {
+			return len(topic) > i
+		}
+		if i >= len(topic) {
+			return false
+		}
+		if p != "*" && p != topic[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(topic)
+}
+
+// brokerExample publishes the rows of both CSV files on their own topic. One
+// subscriber follows everything under "csv", the other only file2 and also
+// picks up the retained row count published before it subscribed.
+func brokerExample() {
+	b := NewBroker()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	all, err := b.Subscribe(ctx, "csv.>")
+	if err != nil {
+		panic(err)
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		for m := range all {
+			fmt.Println("all:", m.Topic, m.Payload)
+		}
+	}()
+
+	for _, name := range []string{"file1", "file2"} {
+		ch, err := read(name + ".csv")
+		if err != nil {
+			panic(err)
+		}
+
+		rows := 0
+		for record := range ch {
+			rows++
+			if err := b.Publish("csv."+name+".row", record); err != nil {
+				panic(err)
+			}
+		}
+		if err := b.PublishRetained("csv."+name+".count", rows); err != nil {
+			panic(err)
+		}
+	}
+
+	late, err := b.Subscribe(ctx, "csv.file2.*", WithBuffer(1), WithOverflow(OverflowDropOldest))
+	if err != nil {
+		panic(err)
+	}
+
+	go func() {
+		defer wg.Done()
+		for m := range late {
+			fmt.Println("late:", m.Topic, m.Payload)
+		}
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvHeader names the columns of a CSV stream.
+type csvHeader struct {
+	names []string
+	index map[string]int
+}
+
+func newCSVHeader(names []string) *csvHeader {
+	h := &csvHeader{names: names, index: make(map[string]int, len(names))}
+	for i, n := range names {
+		n = strings.TrimSpace(n)
+		if _, dup := h.index[n]; !dup {
+			h.index[n] = i
+		}
+	}
+	return h
+}
+
+// Names returns the column names in order.
+func (h *csvHeader) Names() []string {
+	return h.names
+}
+
+// Index returns the position of the named column.
+func (h *csvHeader) Index(name string) (int, bool) {
+	i, ok := h.index[name]
+	return i, ok
+}
+
+// Columns turns column names into indexes, for the stages that take
+// []int column lists.
+func (h *csvHeader) Columns(names ...string) ([]int, error) {
+	cols := make([]int, len(names))
+	for i, n := range names {
+		c, ok := h.index[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", n)
+		}
+		cols[i] = c
+	}
+	return cols, nil
+}
+
+// namedRecord is a record together with the header that names its fields.
+type namedRecord struct {
+	header *csvHeader
+	Fields []string
+}
+
+// Get returns the named field, or "" if the record has no such column.
+func (r namedRecord) Get(name string) string {
+	i, ok := r.header.index[name]
+	if !ok || i >= len(r.Fields) {
+		return ""
+	}
+	return r.Fields[i]
+}
+
+// Map returns the record as column name to value.
+func (r namedRecord) Map() map[string]string {
+	m := make(map[string]string, len(r.header.names))
+	for i, n := range r.header.names {
+		if i < len(r.Fields) {
+			m[n] = r.Fields[i]
+		}
+	}
+	return m
+}
+
+// readWithHeader is read for files whose first row names the columns. The
+// header row is returned separately and not sent on the channel; failing to
+// open the file or read it is returned straight away. Rows of the wrong
+// length are passed on. Reading stops at the first other error, which is
+// sent on the error channel, or when ctx ends, when ctx.Err() is.
+func readWithHeader(ctx context.Context, filename string) (*csvHeader, <-chan []string, <-chan error, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("opening file %w", err)
+	}
+
+	cr := csv.NewReader(f)
+	names, err := cr.Read()
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, fmt.Errorf("reading header: %w", err)
+	}
+
+	ch := make(chan []string)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(ch)
+		defer f.Close()
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil && !errors.Is(err, csv.ErrFieldCount) {
+				errc <- fmt.Errorf("reading %s: %w", filename, err)
+				return
+			}
+
+			select {
+			case ch <- record:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return newCSVHeader(names), ch, errc, nil
+}
+
+// namedRecords attaches header to every record of in.
+func namedRecords(ctx context.Context, header *csvHeader, in <-chan []string) <-chan namedRecord {
+	out := make(chan namedRecord)
+	go func() {
+		defer close(out)
+		for record := range in {
+			select {
+			case out <- namedRecord{header: header, Fields: record}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// structField is how one struct field maps to a CSV column, from its tag:
+//
+//	Name    string    `csv:"name"`
+//	Joined  time.Time `csv:"joined,layout=2006-01-02"`
+//	Ignored string    `csv:"-"`
+//
+// Untagged exported fields use the field name as the column name.
+type structField struct {
+	index  []int
+	column string
+	layout string
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func structFields(t reflect.Type) ([]structField, error) {
+	if t.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("%s is not a struct", t)
+	}
+
+	var fields []structField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		tag := f.Tag.Get("csv")
+		if tag == "-" {
+			continue
+		}
+
+		sf := structField{index: f.Index, column: f.Name, layout: time.RFC3339}
+		parts := strings.Split(tag, ",")
+		if parts[0] != "" {
+			sf.column = parts[0]
+		}
+		for _, opt := range parts[1:] {
+			if strings.HasPrefix(opt, "layout=") {
+				sf.layout = strings.TrimPrefix(opt, "layout=")
+			}
+		}
+		fields = append(fields, sf)
+	}
+	return fields, nil
+}
+
+// setField parses s into v. Empty strings leave pointers nil and other
+// types at their zero value.
+func setField(v reflect.Value, s string, layout string) error {
+	if v.Kind() == reflect.Ptr {
+		if s == "" {
+			return nil
+		}
+		p := reflect.New(v.Type().Elem())
+		if err := setField(p.Elem(), s, layout); err != nil {
+			return err
+		}
+		v.Set(p)
+		return nil
+	}
+
+	if v.Type() == timeType {
+		if s == "" {
+			return nil
+		}
+		t, err := time.Parse(layout, s)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	if s == "" && v.Kind() != reflect.String {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
+
+// formatField is the inverse of setField.
+func formatField(v reflect.Value, layout string) string {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		return formatField(v.Elem(), layout)
+	}
+
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(layout)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if d, ok := v.Interface().(time.Duration); ok {
+			return d.String()
+		}
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// decodeError says which record and column could not be decoded. Record
+// counts from 1 for the first record after the header.
+type decodeError struct {
+	Record int
+	Column string
+	Err    error
+}
+
+func (e *decodeError) Error() string {
+	return fmt.Sprintf("record %d, column %q: %v", e.Record, e.Column, e.Err)
+}
+
+func (e *decodeError) Unwrap() error { return e.Err }
+
+// decodeRecords decodes every record of in into a T, matching struct fields
+// to columns by name. Columns without a field are ignored; fields without a
+// column are left at their zero value. Decoding stops at the first record
+// that fails, and the error is sent on the error channel; the caller then
+// cancels ctx to stop the stages before this one.
+func decodeRecords[T any](ctx context.Context, header *csvHeader, in <-chan []string) (<-chan T, <-chan error) {
+	out := make(chan T)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+
+		fields, err := structFields(reflect.TypeOf((*T)(nil)).Elem())
+		if err != nil {
+			errc <- err
+			return
+		}
+
+		n := 0
+		for record := range in {
+			n++
+
+			var item T
+			v := reflect.ValueOf(&item).Elem()
+			for _, f := range fields {
+				col, ok := header.Index(f.column)
+				if !ok || col >= len(record) {
+					continue
+				}
+				if err := setField(v.FieldByIndex(f.index), record[col], f.layout); err != nil {
+					errc <- &decodeError{Record: n, Column: f.column, Err: err}
+					return
+				}
+			}
+
+			select {
+			case out <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, errc
+}
+
+// encodeRecords turns every T of in into a record. The header to write in
+// front of them is returned straight away.
+func encodeRecords[T any](ctx context.Context, in <-chan T) (*csvHeader, <-chan []string, error) {
+	fields, err := structFields(reflect.TypeOf((*T)(nil)).Elem())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	names := make([]string, len(fields))
+	for i, f := range fields {
+		names[i] = f.column
+	}
+
+	out := make(chan []string)
+	go func() {
+		defer close(out)
+		for item := range in {
+			v := reflect.ValueOf(item)
+			record := make([]string, len(fields))
+			for i, f := range fields {
+				record[i] = formatField(v.FieldByIndex(f.index), f.layout)
+			}
+
+			select {
+			case out <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return newCSVHeader(names), out, nil
+}
+
+type person struct {
+	Name   string    `csv:"name"`
+	Age    int       `csv:"age"`
+	Score  *float64  `csv:"score"`
+	Active bool      `csv:"active"`
+	Joined time.Time `csv:"joined,layout=2006-01-02"`
+}
+
+// headerExample reads people.csv into person values, bumps everyone's age
+// and writes them back out as CSV.
+func headerExample() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	header, ch, readErrc, err := readWithHeader(ctx, "people.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	people, errc := decodeRecords[person](ctx, header, ch)
+
+	older := make(chan person)
+	go func() {
+		defer close(older)
+		for p := range people {
+			fmt.Printf("%+v\n", p)
+			p.Age++
+			older <- p
+		}
+	}()
+
+	outHeader, records, err := encodeRecords(ctx, older)
+	if err != nil {
+		panic(err)
+	}
+
+	w := csv.NewWriter(os.Stdout)
+	w.Write(outHeader.Names())
+	for record := range records {
+		w.Write(record)
+	}
+	w.Flush()
+
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+	if err := <-readErrc; err != nil {
+		panic(err)
+	}
+}
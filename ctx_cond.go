@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CtxCond is a condition variable whose Wait can be cancelled or timed out
+// through a context. sync.Cond parks waiters inside the runtime where nothing
+// can reach them, so listen and condExample block until someone signals.
+// CtxCond parks every waiter on its own channel instead, which lets Wait select
+// on ctx.Done() alongside the wake-up.
+//
+// As with sync.Cond, L must be held when calling Wait or WaitFor, and it is
+// held again when they return, whether or not the wait succeeded.
+type CtxCond struct {
+	L sync.Locker
+
+	mu      sync.Mutex
+	waiters []chan struct{}
+}
+
+func NewCtxCond(l sync.Locker) *CtxCond {
+	return &CtxCond{L: l}
+}
+
+// Wait atomically unlocks c.L and suspends the caller until Signal or
+// Broadcast wakes it, or ctx is done. It returns ctx.Err() when the wait was
+// abandoned; a wake-up that races with cancellation is reported as a
+// successful wait so the signal is never lost.
+func (c *CtxCond) Wait(ctx context.Context) error {
+	ch := make(chan struct{})
+
+	c.mu.Lock()
+	c.waiters = append(c.waiters, ch)
+	c.mu.Unlock()
+
+	c.L.Unlock()
+	defer c.L.Lock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, w := range c.waiters {
+		if w == ch {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return ctx.Err()
+		}
+	}
+
+	// Our channel was already taken off the list by Signal or Broadcast.
+	return nil
+}
+
+// WaitFor waits until predicate returns true or ctx is done. The predicate is
+// always evaluated with c.L held.
+func (c *CtxCond) WaitFor(ctx context.Context, predicate func() bool) error {
+	for !predicate() {
+		if err := c.Wait(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Signal wakes the longest waiting goroutine, if there is one.
+func (c *CtxCond) Signal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.waiters) == 0 {
+		return
+	}
+	close(c.waiters[0])
+	c.waiters = c.waiters[1:]
+}
+
+// Broadcast wakes every waiting goroutine.
+func (c *CtxCond) Broadcast() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, w := range c.waiters {
+		close(w)
+	}
+	c.waiters = nil
+}
+
+// ctxCondExample is differentCondExample without the OS signal: each listener
+// gives up after a timeout instead of blocking forever.
+func ctxCondExample() {
+	var age = make(map[string]int)
+
+	m := sync.Mutex{}
+	cond := NewCtxCond(&m)
+
+	wg := sync.WaitGroup{}
+	wg.Add(3)
+
+	listen := func(name string, timeout time.Duration) {
+		defer wg.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		cond.L.Lock()
+		defer cond.L.Unlock()
+
+		err := cond.WaitFor(ctx, func() bool {
+			_, ok := age["T"]
+			return ok
+		})
+		if err != nil {
+			fmt.Println(name, " gave up:", err)
+			return
+		}
+		fmt.Println(name, " age:", age["T"])
+	}
+
+	go listen("lis1", 2*time.Second)
+	go listen("lis2", 500*time.Millisecond)
+
+	go func() {
+		defer wg.Done()
+
+		time.Sleep(time.Second)
+		cond.L.Lock()
+		age["T"] = 25
+		cond.Broadcast()
+		cond.L.Unlock()
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+type cond interface {
+	wait()
+	signal()
+}
+
+type syncCondAdapter struct{ c *sync.Cond }
+
+func (s syncCondAdapter) wait()   { s.c.Wait() }
+func (s syncCondAdapter) signal() { s.c.Signal() }
+
+type ctxCondAdapter struct{ c *CtxCond }
+
+func (s ctxCondAdapter) wait()   { _ = s.c.Wait(context.Background()) }
+func (s ctxCondAdapter) signal() { s.c.Signal() }
+
+// benchmarkPingPong hands a turn back and forth between two goroutines
+// through the condition variable newCond makes.
+func benchmarkPingPong(b *testing.B, newCond func(l sync.Locker) cond) {
+	b.ReportAllocs()
+	m := sync.Mutex{}
+	c := newCond(&m)
+	turn := 0
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Lock()
+		for i := 0; i < b.N; i++ {
+			for turn != 1 {
+				c.wait()
+			}
+			turn = 0
+			c.signal()
+		}
+		m.Unlock()
+	}()
+
+	m.Lock()
+	for i := 0; i < b.N; i++ {
+		turn = 1
+		c.signal()
+		for turn != 0 {
+			c.wait()
+		}
+	}
+	m.Unlock()
+	<-done
+}
+
+func BenchmarkSyncCond(b *testing.B) {
+	benchmarkPingPong(b, func(l sync.Locker) cond { return syncCondAdapter{sync.NewCond(l)} })
+}
+
+func BenchmarkCtxCond(b *testing.B) {
+	benchmarkPingPong(b, func(l sync.Locker) cond { return ctxCondAdapter{NewCtxCond(l)} })
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// deadLetter is one item a pipeline could not handle, with enough context to
+// find out why and to send it through again later.
+type deadLetter struct {
+	Time   time.Time `json:"time"`
+	Stage  string    `json:"stage"`
+	Source string    `json:"source,omitempty"`
+	Line   int       `json:"line,omitempty"`  // line in Source, if known
+	Index  int       `json:"index,omitempty"` // position in the stage's input, counting from 1
+	Error  string    `json:"error"`
+	Record []string  `json:"record"`
+
+	// Raw is the text of a row that couldn't be parsed into Record, so it
+	// can be parsed again on replay.
+	Raw string `json:"raw,omitempty"`
+}
+
+// deadLetterQueue appends dead letters to a local JSON Lines file. Entries
+// are never rewritten, so the file doubles as a log of every failure.
+type deadLetterQueue struct {
+	mu   sync.Mutex
+	f    *os.File
+	sync bool
+}
+
+// openDeadLetterQueue opens path for appending, creating it if needed. With
+// sync set every entry is flushed to disk before Add returns.
+func openDeadLetterQueue(path string, sync bool) (*deadLetterQueue, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening dead letter file: %w", err)
+	}
+	return &deadLetterQueue{f: f, sync: sync}, nil
+}
+
+// Add appends d, stamping it with the current time if it has none.
+func (q *deadLetterQueue) Add(d deadLetter) error {
+	if d.Time.IsZero() {
+		d.Time = time.Now().UTC()
+	}
+
+	line, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("encoding dead letter: %w", err)
+	}
+	line = append(line, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// A single write of the whole line keeps entries from interleaving
+	// even if several processes append to the same file.
+	if _, err := q.f.Write(line); err != nil {
+		return fmt.Errorf("writing dead letter: %w", err)
+	}
+	if q.sync {
+		if err := q.f.Sync(); err != nil {
+			return fmt.Errorf("syncing dead letter file: %w", err)
+		}
+	}
+	return nil
+}
+
+func (q *deadLetterQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.f.Close()
+}
+
+// onError returns a callback that records failed records for stage, for use
+// as the onError of LimitStage and similar stages. The callback has no way
+// to return an error, so failures to store a record are logged to stderr.
+func (q *deadLetterQueue) onError(stage, source string) func([]string, error) {
+	return func(record []string, err error) {
+		if addErr := q.Add(deadLetter{Stage: stage, Source: source, Error: err.Error(), Record: record}); addErr != nil {
+			fmt.Fprintf(os.Stderr, "dead letter lost: %v: %v\n", addErr, record)
+		}
+	}
+}
+
+// quarantine stores every invalid record from validateRecords until the
+// channel is closed, and returns the first error writing them. validateRecords
+// only knows each record's position in its input, which is kept as Index;
+// with a header row or multi-line fields it isn't the line number.
+func (q *deadLetterQueue) quarantine(stage, source string, invalid <-chan invalidRecord) error {
+	var firstErr error
+	for bad := range invalid {
+		err := q.Add(deadLetter{
+			Stage:  stage,
+			Source: source,
+			Index:  bad.Index,
+			Error:  strings.Join(bad.Reasons, "; "),
+			Record: bad.Record,
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// deadLetterFilter selects dead letters. Empty fields match everything.
+type deadLetterFilter struct {
+	Stage  string
+	Source string
+	Match  string // substring of the error
+	Since  time.Time
+}
+
+func (f deadLetterFilter) match(d deadLetter) bool {
+	return (f.Stage == "" || d.Stage == f.Stage) &&
+		(f.Source == "" || d.Source == f.Source) &&
+		(f.Match == "" || strings.Contains(d.Error, f.Match)) &&
+		(f.Since.IsZero() || !d.Time.Before(f.Since))
+}
+
+// readDeadLetters returns the entries of the file at path that match filter,
+// oldest first.
+func readDeadLetters(path string, filter deadLetterFilter) ([]deadLetter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening dead letter file: %w", err)
+	}
+	defer f.Close()
+
+	var letters []deadLetter
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var d deadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("dead letter file line %d: %w", n, err)
+		}
+		if filter.match(d) {
+			letters = append(letters, d)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading dead letter file: %w", err)
+	}
+
+	sort.SliceStable(letters, func(i, j int) bool { return letters[i].Time.Before(letters[j].Time) })
+	return letters, nil
+}
+
+// lineRecorder passes r on to a csv.Reader a line at a time and keeps the
+// text of each line, so a row the csv.Reader can't parse can be stored as it
+// was. Lines are numbered from 1, as in csv.ParseError.
+type lineRecorder struct {
+	r     *bufio.Reader
+	cur   string // line being passed on
+	off   int    // how much of cur has been
+	lines []string
+	first int // number of lines[0]
+}
+
+func newLineRecorder(r io.Reader) *lineRecorder {
+	return &lineRecorder{r: bufio.NewReader(r), first: 1}
+}
+
+func (l *lineRecorder) Read(p []byte) (int, error) {
+	if l.off == len(l.cur) {
+		line, err := l.r.ReadString('\n')
+		if line == "" {
+			return 0, err
+		}
+		l.lines = append(l.lines, line)
+		l.cur, l.off = line, 0
+	}
+	n := copy(p, l.cur[l.off:])
+	l.off += n
+	return n, nil
+}
+
+// text returns lines from to to, without the last line's line ending.
+func (l *lineRecorder) text(from, to int) string {
+	if from < l.first {
+		from = l.first
+	}
+	if to >= l.first+len(l.lines) {
+		to = l.first + len(l.lines) - 1
+	}
+	if from > to {
+		return ""
+	}
+	text := strings.Join(l.lines[from-l.first:to-l.first+1], "")
+	return strings.TrimRight(text, "\r\n")
+}
+
+// forget drops the lines before n, which are no longer needed.
+func (l *lineRecorder) forget(n int) {
+	for l.first < n && len(l.lines) > 0 {
+		l.lines[0] = ""
+		l.lines = l.lines[1:]
+		l.first++
+	}
+}
+
+// readCSVDeadLetter is readCSV that sends rows it can't parse, or that don't
+// have three fields, to dlq with their line number instead of passing them
+// on to the next stage. Rows that can't be parsed at all are stored as
+// their raw text. Reading stops if a dead letter can't be stored, and that
+// error, or one opening the file, is sent on the error channel.
+func readCSVDeadLetter(filename string, dlq *deadLetterQueue) (<-chan []string, <-chan error) {
+	ch := make(chan []string)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(ch)
+
+		file, err := os.Open(filename)
+		if err != nil {
+			errc <- fmt.Errorf("error opening file: %w", err)
+			return
+		}
+		defer file.Close()
+
+		lines := newLineRecorder(file)
+		cr := csv.NewReader(lines)
+		cr.FieldsPerRecord = 3
+		for {
+			record, err := cr.Read()
+			if len(record) > 0 {
+				line, _ := cr.FieldPos(0)
+				lines.forget(line)
+			}
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				var pe *csv.ParseError
+				if !errors.As(err, &pe) {
+					if addErr := dlq.Add(deadLetter{Stage: "readCSV", Source: filename, Error: err.Error()}); addErr != nil {
+						errc <- addErr
+						return
+					}
+					errc <- fmt.Errorf("reading %s: %w", filename, err)
+					return
+				}
+				d := deadLetter{Stage: "readCSV", Source: filename, Line: pe.StartLine, Error: pe.Err.Error(), Record: record}
+				if !errors.Is(pe.Err, csv.ErrFieldCount) {
+					// Whatever fields were read before the error are only
+					// part of the row.
+					d.Record = nil
+					d.Raw = lines.text(pe.StartLine, pe.Line)
+				}
+				lines.forget(pe.Line + 1)
+				if err := dlq.Add(d); err != nil {
+					errc <- err
+					return
+				}
+				continue
+			}
+			ch <- record
+		}
+	}()
+
+	return ch, errc
+}
+
+// replayPipelines are the pipelines dead letters can be replayed through,
+// by name.
+var replayPipelines = map[string]func(<-chan []string) <-chan []string{
+	"sanitize":  sanitize,
+	"titleCase": titleCase,
+	"sanitize,titleCase": func(in <-chan []string) <-chan []string {
+		return titleCase(sanitize(in))
+	},
+}
+
+// replayRecord returns the record of d, parsing its raw text if it has no
+// record. Quotes are parsed leniently, as a bad quote is the usual reason a
+// row ended up here; fixing the pipeline it is replayed through is how the
+// row gets through the rest.
+func replayRecord(d deadLetter) ([]string, error) {
+	if len(d.Record) > 0 || d.Raw == "" {
+		return d.Record, nil
+	}
+	cr := csv.NewReader(strings.NewReader(d.Raw))
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	record, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("parsing dead letter from %s:%d: %w", d.Source, d.Line, err)
+	}
+	return record, nil
+}
+
+// replayDeadLetters sends the records of letters through the named pipeline
+// and returns its output. Letters stored as raw text are parsed first, and
+// nothing is replayed if one of them can't be.
+func replayDeadLetters(ctx context.Context, letters []deadLetter, pipeline string) (<-chan []string, error) {
+	stage, ok := replayPipelines[pipeline]
+	if !ok {
+		names := make([]string, 0, len(replayPipelines))
+		for name := range replayPipelines {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown pipeline %q, want one of %s", pipeline, strings.Join(names, ", "))
+	}
+
+	records := make([][]string, 0, len(letters))
+	for _, d := range letters {
+		record, err := replayRecord(d)
+		if err != nil {
+			return nil, err
+		}
+		if len(record) > 0 {
+			records = append(records, record)
+		}
+	}
+
+	in := make(chan []string)
+	go func() {
+		defer close(in)
+		for _, record := range records {
+			select {
+			case in <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return stage(in), nil
+}
+
+// deadLetterExample reads broken.csv through sanitize and titleCase. The
+// malformed rows end up in dead_letters.jsonl, from where
+//
+//	concurrency_in_go dlq list
+//	concurrency_in_go dlq replay -pipeline titleCase
+//
+// show and replay them.
+func deadLetterExample() {
+	dlq, err := openDeadLetterQueue("dead_letters.jsonl", false)
+	if err != nil {
+		panic(err)
+	}
+	defer dlq.Close()
+
+	ch, errc := readCSVDeadLetter("broken.csv", dlq)
+	for v := range titleCase(sanitize(ch)) {
+		fmt.Println(v)
+	}
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+}
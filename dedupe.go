@@ -0,0 +1,217 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type dedupeOptions struct {
+	// Key is the columns that make two records duplicates. When empty the
+	// whole record is compared.
+	Key []int
+
+	// Capacity is how many keys exact mode remembers, dropping the least
+	// recently seen beyond that. Defaults to 100000.
+	Capacity int
+
+	// TTL makes exact mode forget a key this long after it was last seen.
+	// Zero keeps keys until they are pushed out by Capacity.
+	TTL time.Duration
+
+	// Approximate switches to a Bloom filter sized for ExpectedItems keys
+	// with the given FalsePositiveRate. A false positive drops a record that
+	// wasn't a duplicate; duplicates are never let through.
+	Approximate       bool
+	ExpectedItems     int
+	FalsePositiveRate float64
+}
+
+// seenSet remembers keys. add reports whether key had been added before.
+type seenSet interface {
+	add(key string) bool
+}
+
+type lruEntry struct {
+	key  string
+	seen time.Time
+}
+
+// lruSet is an exact seenSet holding at most capacity keys.
+type lruSet struct {
+	capacity int
+	ttl      time.Duration
+	order    *list.List // most recently seen first
+	entries  map[string]*list.Element
+	now      func() time.Time
+}
+
+func newLRUSet(capacity int, ttl time.Duration) *lruSet {
+	return &lruSet{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+func (s *lruSet) add(key string) bool {
+	now := s.now()
+
+	if s.ttl > 0 {
+		for back := s.order.Back(); back != nil; back = s.order.Back() {
+			e := back.Value.(*lruEntry)
+			if now.Sub(e.seen) < s.ttl {
+				break
+			}
+			s.order.Remove(back)
+			delete(s.entries, e.key)
+		}
+	}
+
+	if el, ok := s.entries[key]; ok {
+		el.Value.(*lruEntry).seen = now
+		s.order.MoveToFront(el)
+		return true
+	}
+
+	s.entries[key] = s.order.PushFront(&lruEntry{key: key, seen: now})
+	if s.order.Len() > s.capacity {
+		back := s.order.Back()
+		s.order.Remove(back)
+		delete(s.entries, back.Value.(*lruEntry).key)
+	}
+	return false
+}
+
+// bloomFilter is an approximate seenSet using a fixed amount of memory.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64
+	hashes int
+}
+
+// newBloomFilter sizes a filter so that after n keys the chance of a false
+// positive is about p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+
+	words := (uint64(m) + 63) / 64
+	return &bloomFilter{bits: make([]uint64, words), m: words * 64, hashes: k}
+}
+
+func (b *bloomFilter) add(key string) bool {
+	// Kirsch-Mitzenmacher: k hashes derived from the two halves of one.
+	h := hashKey(key)
+	h1, h2 := h&0xffffffff, h>>32|1
+
+	present := true
+	for i := 0; i < b.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if b.bits[word]&mask == 0 {
+			present = false
+			b.bits[word] |= mask
+		}
+	}
+	return present
+}
+
+// dedupeStats counts what a dedupe stage let through and dropped.
+type dedupeStats struct {
+	seen    uint64
+	dropped uint64
+}
+
+// Seen returns how many records the stage has read.
+func (s *dedupeStats) Seen() uint64 { return atomic.LoadUint64(&s.seen) }
+
+// Dropped returns how many records were dropped as duplicates.
+func (s *dedupeStats) Dropped() uint64 { return atomic.LoadUint64(&s.dropped) }
+
+// dedupe passes on the first record with each key and drops the rest, using
+// bounded memory either way: exact mode forgets old keys, approximate mode
+// may drop a small share of records that weren't duplicates.
+func dedupe(ctx context.Context, in <-chan []string, opts dedupeOptions) (<-chan []string, *dedupeStats) {
+	var set seenSet
+	if opts.Approximate {
+		set = newBloomFilter(opts.ExpectedItems, opts.FalsePositiveRate)
+	} else {
+		capacity := opts.Capacity
+		if capacity <= 0 {
+			capacity = 100000
+		}
+		set = newLRUSet(capacity, opts.TTL)
+	}
+
+	key := func(record []string) string {
+		return strings.Join(record, "\x1f")
+	}
+	if len(opts.Key) > 0 {
+		key = columnKey(opts.Key...)
+	}
+
+	out := make(chan []string)
+	stats := &dedupeStats{}
+
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case record, ok := <-in:
+				if !ok {
+					return
+				}
+				atomic.AddUint64(&stats.seen, 1)
+				if set.add(key(record)) {
+					atomic.AddUint64(&stats.dropped, 1)
+					continue
+				}
+				select {
+				case out <- record:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, stats
+}
+
+// dedupeExample merges combo.csv with the two files it was made from and
+// keeps one copy of every row.
+func dedupeExample() {
+	var inputs []<-chan []string
+	for _, name := range []string{"combo.csv", "file1.csv", "file2.csv"} {
+		ch, err := read(name)
+		if err != nil {
+			panic(err)
+		}
+		inputs = append(inputs, ch)
+	}
+
+	unique, stats := dedupe(context.Background(), merge(inputs...), dedupeOptions{Capacity: 1000})
+	for v := range unique {
+		fmt.Println(v)
+	}
+	fmt.Println("seen:", stats.Seen(), "dropped:", stats.Dropped())
+}
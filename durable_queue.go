@@ -0,0 +1,809 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type syncPolicy int
+
+const (
+	// syncAlways fsyncs every append and ack before returning: nothing
+	// acknowledged is lost, even to a power cut.
+	syncAlways syncPolicy = iota
+
+	// syncPeriodic fsyncs every SyncInterval. A crashed process loses
+	// nothing, as its writes are already with the OS; a crashed machine
+	// loses up to the last interval.
+	syncPeriodic
+
+	// syncNever leaves flushing to the OS.
+	syncNever
+)
+
+type durableQueueOptions struct {
+	// SegmentSize is the size at which a new segment file is started, 64MB
+	// by default.
+	SegmentSize int64
+
+	Sync syncPolicy
+
+	// SyncInterval is how often syncPeriodic syncs, a second by default.
+	SyncInterval time.Duration
+}
+
+// errCorruptEntry marks an entry that was cut short or doesn't match its
+// checksum, which is what a crash in the middle of an append leaves behind.
+var errCorruptEntry = errors.New("corrupt queue entry")
+
+// Each entry is its payload's length and CRC-32, four bytes each, followed
+// by the payload, a JSON array of the record's fields.
+const (
+	entryHeaderSize = 8
+	maxEntrySize    = 1 << 30
+)
+
+func encodeEntry(record []string) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("encoding record: %w", err)
+	}
+	entry := make([]byte, entryHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(entry[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(entry[4:8], crc32.ChecksumIEEE(payload))
+	copy(entry[entryHeaderSize:], payload)
+	return entry, nil
+}
+
+// readEntry returns the payload of the next entry, io.EOF if there is none,
+// or errCorruptEntry.
+func readEntry(r *bufio.Reader) ([]byte, error) {
+	var header [entryHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errCorruptEntry
+		}
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[0:4])
+	if n > maxEntrySize {
+		return nil, errCorruptEntry
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errCorruptEntry
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, errCorruptEntry
+	}
+	return payload, nil
+}
+
+func segmentName(base uint64) string {
+	return fmt.Sprintf("%020d.seg", base)
+}
+
+// durableQueue is a queue of records kept in a directory, so it outlives
+// the process:
+//
+//	dir/00000000000000000000.seg    entries 0 to n-1
+//	dir/0000000000000000000n.seg    entries n onwards
+//	dir/consumers/<name>.offset     the next entry <name> hasn't acked
+//
+// Segments are only ever appended to. Every entry has an offset, counting
+// from 0 across segments, and each named consumer reads from its last
+// acknowledged offset, so a restarted process carries on where it stopped.
+type durableQueue struct {
+	dir  string
+	opts durableQueueOptions
+
+	mu        sync.Mutex
+	cond      *CtxCond // broadcast on append and close
+	segments  []uint64 // base offsets, ascending
+	f         *os.File // the last segment
+	size      int64
+	next      uint64 // offset of the next append
+	dirty     bool
+	closed    bool
+	consumers map[string]*durableConsumer
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// openDurableQueue opens the queue in dir, creating it if needed. An entry
+// left half-written by a crash is cut off.
+func openDurableQueue(dir string, opts durableQueueOptions) (*durableQueue, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = 64 << 20
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = time.Second
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, "consumers"), 0o755); err != nil {
+		return nil, fmt.Errorf("creating queue directory: %w", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading queue directory: %w", err)
+	}
+
+	q := &durableQueue{dir: dir, opts: opts, consumers: make(map[string]*durableConsumer)}
+	q.cond = NewCtxCond(&q.mu)
+
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, ".seg"), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, base)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+	if len(q.segments) == 0 {
+		q.segments = []uint64{0}
+	}
+
+	last := q.segments[len(q.segments)-1]
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(last)), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening segment: %w", err)
+	}
+
+	count, size, err := scanSegment(f)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+	if err == nil {
+		_, err = f.Seek(size, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("recovering segment: %w", err)
+	}
+
+	q.f = f
+	q.size = size
+	q.next = last + count
+
+	if opts.Sync == syncPeriodic {
+		q.stop = make(chan struct{})
+		q.stopped = make(chan struct{})
+		go q.syncLoop()
+	}
+	return q, nil
+}
+
+// scanSegment counts the whole entries at the start of f and returns their
+// size in bytes.
+func scanSegment(f *os.File) (uint64, int64, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+
+	r := bufio.NewReader(f)
+	var count uint64
+	var size int64
+	for {
+		payload, err := readEntry(r)
+		if errors.Is(err, io.EOF) || errors.Is(err, errCorruptEntry) {
+			return count, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		count++
+		size += int64(entryHeaderSize + len(payload))
+	}
+}
+
+// Append adds record to the end of the queue and returns its offset.
+func (q *durableQueue) Append(record []string) (uint64, error) {
+	entry, err := encodeEntry(record)
+	if err != nil {
+		return 0, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return 0, ErrQueueClosed
+	}
+
+	if q.size > 0 && q.size+int64(len(entry)) > q.opts.SegmentSize {
+		if err := q.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	// One write per entry, so readers, which never look past q.next, only
+	// ever see whole entries.
+	if _, err := q.f.Write(entry); err != nil {
+		q.f.Truncate(q.size)
+		q.f.Seek(q.size, io.SeekStart)
+		return 0, fmt.Errorf("appending to queue: %w", err)
+	}
+	q.size += int64(len(entry))
+
+	offset := q.next
+	q.next++
+	q.cond.Broadcast()
+
+	if q.opts.Sync != syncAlways {
+		q.dirty = true
+		return offset, nil
+	}
+	// The entry is in the queue either way; the error says it may not
+	// survive a power cut.
+	if err := q.f.Sync(); err != nil {
+		return offset, fmt.Errorf("syncing queue: %w", err)
+	}
+	return offset, nil
+}
+
+// rotate finishes the current segment and starts a new one. q.mu is held.
+func (q *durableQueue) rotate() error {
+	if err := q.f.Sync(); err != nil {
+		return fmt.Errorf("syncing segment: %w", err)
+	}
+	q.f.Close()
+
+	f, err := os.OpenFile(filepath.Join(q.dir, segmentName(q.next)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("creating segment: %w", err)
+	}
+	q.f = f
+	q.size = 0
+	q.segments = append(q.segments, q.next)
+	return nil
+}
+
+func (q *durableQueue) syncLoop() {
+	defer close(q.stopped)
+
+	t := time.NewTicker(q.opts.SyncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			q.mu.Lock()
+			if q.dirty {
+				q.f.Sync()
+				q.dirty = false
+			}
+			for _, c := range q.consumers {
+				c.syncOffset()
+			}
+			q.mu.Unlock()
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Len returns how many entries have ever been appended.
+func (q *durableQueue) Len() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.next
+}
+
+// Close stops further appends and flushes the queue to disk. Consumers can
+// still read what is left, after which Next returns ErrQueueClosed.
+func (q *durableQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	err := q.f.Sync()
+	if cerr := q.f.Close(); err == nil {
+		err = cerr
+	}
+	for _, c := range q.consumers {
+		c.syncOffset()
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	if q.stop != nil {
+		close(q.stop)
+		<-q.stopped
+	}
+	if err != nil {
+		return fmt.Errorf("closing queue: %w", err)
+	}
+	return nil
+}
+
+// Compact deletes the segments every consumer that has ever acked has read
+// past, and returns how many it deleted. The last segment is always kept.
+func (q *durableQueue) Compact() (int, error) {
+	offsets, err := os.ReadDir(filepath.Join(q.dir, "consumers"))
+	if err != nil {
+		return 0, fmt.Errorf("reading consumers: %w", err)
+	}
+
+	var low uint64
+	found := false
+	for _, e := range offsets {
+		if !strings.HasSuffix(e.Name(), ".offset") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(q.dir, "consumers", e.Name()))
+		if err != nil {
+			return 0, fmt.Errorf("reading consumer offset: %w", err)
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			n = 0
+		}
+		if !found || n < low {
+			low, found = n, true
+		}
+	}
+	if !found {
+		return 0, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := 0
+	for len(q.segments) > 1 && q.segments[1] <= low {
+		if err := os.Remove(filepath.Join(q.dir, segmentName(q.segments[0]))); err != nil {
+			return removed, fmt.Errorf("removing segment: %w", err)
+		}
+		q.segments = q.segments[1:]
+		removed++
+	}
+	return removed, nil
+}
+
+// segmentFor returns the base of the segment holding offset. q.mu is held.
+func (q *durableQueue) segmentFor(offset uint64) uint64 {
+	i := sort.Search(len(q.segments), func(i int) bool { return q.segments[i] > offset })
+	if i == 0 {
+		return q.segments[0]
+	}
+	return q.segments[i-1]
+}
+
+// durableConsumer reads a durableQueue from the offset it last acked. A
+// consumer is used by one goroutine at a time, though Ack may be called
+// from another.
+type durableConsumer struct {
+	q    *durableQueue
+	name string
+
+	pos uint64 // next offset to read
+	seg *os.File
+	r   *bufio.Reader
+
+	ackMu     sync.Mutex
+	offFile   *os.File
+	committed uint64 // next offset not acked
+	unsynced  bool
+}
+
+// Consumer opens the named consumer, which starts at the offset after the
+// last one it acked, or at the oldest entry the first time.
+func (q *durableQueue) Consumer(name string) (*durableConsumer, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, fmt.Errorf("invalid consumer name %q", name)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.consumers[name]; ok {
+		return nil, fmt.Errorf("consumer %q is already open", name)
+	}
+
+	f, err := os.OpenFile(filepath.Join(q.dir, "consumers", name+".offset"), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening consumer offset: %w", err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading consumer offset: %w", err)
+	}
+
+	var committed uint64
+	if s := strings.TrimSpace(string(data)); s != "" {
+		if committed, err = strconv.ParseUint(s, 10, 64); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("consumer %q: bad offset %q", name, s)
+		}
+	}
+	if committed < q.segments[0] {
+		// Compacted away; start at the oldest entry left.
+		committed = q.segments[0]
+	}
+	if committed > q.next {
+		committed = q.next
+	}
+
+	c := &durableConsumer{q: q, name: name, pos: committed, offFile: f, committed: committed}
+	q.consumers[name] = c
+	return c, nil
+}
+
+// Next returns the next entry, waiting for one to be appended if needed. It
+// returns ErrQueueClosed once the queue is closed and everything in it has
+// been read.
+func (c *durableConsumer) Next(ctx context.Context) (uint64, []string, error) {
+	q := c.q
+	for {
+		q.mu.Lock()
+		err := q.cond.WaitFor(ctx, func() bool { return c.pos < q.next || q.closed })
+		if err == nil && c.pos >= q.next {
+			err = ErrQueueClosed
+		}
+		var base uint64
+		if err == nil && c.seg == nil {
+			base = q.segmentFor(c.pos)
+		}
+		q.mu.Unlock()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if c.seg == nil {
+			if err := c.open(base); err != nil {
+				return 0, nil, err
+			}
+		}
+
+		payload, err := readEntry(c.r)
+		if errors.Is(err, io.EOF) {
+			// This segment is finished and the entry is in the next one.
+			c.closeSegment()
+			continue
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("reading queue at offset %d: %w", c.pos, err)
+		}
+
+		var record []string
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return 0, nil, fmt.Errorf("decoding queue entry %d: %w", c.pos, err)
+		}
+		offset := c.pos
+		c.pos++
+		return offset, record, nil
+	}
+}
+
+// open opens the segment starting at base and skips to c.pos.
+func (c *durableConsumer) open(base uint64) error {
+	f, err := os.Open(filepath.Join(c.q.dir, segmentName(base)))
+	if err != nil {
+		return fmt.Errorf("opening segment: %w", err)
+	}
+	r := bufio.NewReader(f)
+
+	for i := base; i < c.pos; i++ {
+		var header [entryHeaderSize]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			f.Close()
+			return fmt.Errorf("seeking to offset %d: %w", c.pos, err)
+		}
+		if _, err := r.Discard(int(binary.BigEndian.Uint32(header[0:4]))); err != nil {
+			f.Close()
+			return fmt.Errorf("seeking to offset %d: %w", c.pos, err)
+		}
+	}
+
+	c.seg, c.r = f, r
+	return nil
+}
+
+func (c *durableConsumer) closeSegment() {
+	if c.seg != nil {
+		c.seg.Close()
+		c.seg, c.r = nil, nil
+	}
+}
+
+// Ack marks every entry up to and including offset as done, so a consumer
+// opened later starts after it. Acks are cumulative: acking an offset also
+// acks all the ones before it.
+func (c *durableConsumer) Ack(offset uint64) error {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+
+	if offset+1 <= c.committed {
+		return nil
+	}
+	c.committed = offset + 1
+
+	// A fixed-width number written in place, so the file never holds a mix
+	// of an old and a new offset.
+	if _, err := c.offFile.WriteAt([]byte(fmt.Sprintf("%020d\n", c.committed)), 0); err != nil {
+		return fmt.Errorf("writing consumer offset: %w", err)
+	}
+	if c.q.opts.Sync == syncAlways {
+		if err := c.offFile.Sync(); err != nil {
+			return fmt.Errorf("syncing consumer offset: %w", err)
+		}
+		return nil
+	}
+	c.unsynced = true
+	return nil
+}
+
+// Committed returns the offset the consumer would start from if reopened.
+func (c *durableConsumer) Committed() uint64 {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	return c.committed
+}
+
+func (c *durableConsumer) syncOffset() {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	if c.unsynced {
+		c.offFile.Sync()
+		c.unsynced = false
+	}
+}
+
+func (c *durableConsumer) Close() error {
+	c.q.mu.Lock()
+	delete(c.q.consumers, c.name)
+	c.q.mu.Unlock()
+
+	c.closeSegment()
+	c.syncOffset()
+	return c.offFile.Close()
+}
+
+// durableItem is a record read from a durableQueue, to be acked once it has
+// been dealt with.
+type durableItem struct {
+	Offset uint64
+	Record []string
+	c      *durableConsumer
+}
+
+func (it durableItem) Ack() error {
+	return it.c.Ack(it.Offset)
+}
+
+// durableConnect puts q between in and the returned channel: every record
+// of in is appended to q, and c reads them back out. When in is closed the
+// output closes once c has read everything appended to q up to then, or
+// earlier if q's owner closes it. q is left open, so it can be shared with
+// other stages and is closed by whoever opened it. Records are only lost to
+// a crash while they are still in in, and come back after a restart until
+// they are acked. The caller closes c after its last Ack.
+func durableConnect(ctx context.Context, in <-chan []string, q *durableQueue, c *durableConsumer) (<-chan durableItem, <-chan error) {
+	out := make(chan durableItem)
+	errc := make(chan error, 1)
+
+	// Once in is finished the writer sets end to q's length and cancels
+	// readCtx, which wakes the reader if it is waiting for more.
+	readCtx, inDone := context.WithCancel(ctx)
+	var end uint64
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		defer func() {
+			end = q.Len()
+			inDone()
+		}()
+		for {
+			select {
+			case record, ok := <-in:
+				if !ok {
+					return
+				}
+				if _, err := q.Append(record); err != nil {
+					fail(err)
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer close(out)
+		for {
+			if readCtx.Err() != nil && ctx.Err() == nil && c.pos >= end {
+				return
+			}
+			offset, record, err := c.Next(readCtx)
+			if errors.Is(err, context.Canceled) && ctx.Err() == nil {
+				// in is finished; go round to check for the rest.
+				continue
+			}
+			if errors.Is(err, ErrQueueClosed) || ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+
+			select {
+			case out <- durableItem{Offset: offset, Record: record, c: c}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		inDone()
+		switch {
+		case firstErr != nil:
+			errc <- firstErr
+		case ctx.Err() != nil:
+			errc <- ctx.Err()
+		}
+		close(errc)
+	}()
+
+	return out, errc
+}
+
+// durableStage is durableConnect for stages that take plain records, with
+// the named consumer. It acks a record once the next stage comes back for
+// another, so after a crash the record it was working on is delivered
+// again. Only the last record is acked before the next stage is done with
+// it, when the output is closed.
+func durableStage(ctx context.Context, in <-chan []string, q *durableQueue, consumer string) (<-chan []string, <-chan error) {
+	out := make(chan []string)
+	errc := make(chan error, 1)
+
+	c, err := q.Consumer(consumer)
+	if err != nil {
+		errc <- err
+		close(errc)
+		close(out)
+		return out, errc
+	}
+
+	items, connErrc := durableConnect(ctx, in, q, c)
+
+	go func() {
+		defer close(errc)
+
+		var ackErr error
+		ack := func(it durableItem) {
+			if err := it.Ack(); err != nil && ackErr == nil {
+				ackErr = err
+			}
+		}
+
+		var prev *durableItem
+		for it := range items {
+			it := it
+			select {
+			case out <- it.Record:
+			case <-ctx.Done():
+				// durableConnect sees ctx too and will finish.
+				for range items {
+				}
+				prev = nil
+				continue
+			}
+			if prev != nil {
+				ack(*prev)
+			}
+			prev = &it
+		}
+		if prev != nil && ctx.Err() == nil {
+			ack(*prev)
+		}
+		close(out)
+
+		err := <-connErrc
+		if err == nil {
+			err = ackErr
+		}
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			errc <- err
+		}
+	}()
+
+	return out, errc
+}
+
+// durableQueueExample feeds pipeline.csv through a queue in the queue
+// directory, stopping after two records as if the process had died, then
+// opens the queue again and finishes from where it stopped.
+func durableQueueExample() {
+	os.RemoveAll("queue")
+
+	q, err := openDurableQueue("queue", durableQueueOptions{Sync: syncPeriodic})
+	if err != nil {
+		panic(err)
+	}
+
+	ch, err := readCSV("pipeline.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	out, errc := durableStage(ctx, sanitize(ch), q, "titleCase")
+	n := 0
+	for v := range titleCase(out) {
+		fmt.Println("first run", v)
+		if n++; n == 2 {
+			cancel()
+		}
+	}
+	<-errc
+	q.Close()
+
+	q, err = openDurableQueue("queue", durableQueueOptions{Sync: syncPeriodic})
+	if err != nil {
+		panic(err)
+	}
+	c, err := q.Consumer("titleCase")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("resuming at offset", c.Committed(), "of", q.Len())
+	q.Close()
+	for {
+		offset, record, err := c.Next(context.Background())
+		if err != nil {
+			break
+		}
+		fmt.Println("second run", offset, record)
+		c.Ack(offset)
+	}
+	c.Close()
+}
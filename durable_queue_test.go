@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func openTestQueue(t *testing.T, dir string, opts durableQueueOptions) *durableQueue {
+	t.Helper()
+	q, err := openDurableQueue(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func appendRecords(t *testing.T, q *durableQueue, records ...[]string) {
+	t.Helper()
+	for _, r := range records {
+		if _, err := q.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readAll reads c until the queue is closed and empty.
+func readAll(t *testing.T, c *durableConsumer) ([]uint64, [][]string) {
+	t.Helper()
+	var offsets []uint64
+	var records [][]string
+	for {
+		offset, record, err := c.Next(context.Background())
+		if errors.Is(err, ErrQueueClosed) {
+			return offsets, records
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, offset)
+		records = append(records, record)
+	}
+}
+
+// damageTail changes the last segment of the queue in dir with fn.
+func damageTail(t *testing.T, dir string, fn func([]byte) []byte) {
+	t.Helper()
+	path := filepath.Join(dir, segmentName(0))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, fn(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDurableQueueRecovery(t *testing.T) {
+	last, err := encodeEntry([]string{"c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		damage func([]byte) []byte
+	}{
+		{"torn header", func(data []byte) []byte {
+			return append(data, last[:entryHeaderSize/2]...)
+		}},
+		{"torn payload", func(data []byte) []byte {
+			return append(data, last[:len(last)-1]...)
+		}},
+		{"bad checksum", func(data []byte) []byte {
+			entry := append([]byte(nil), last...)
+			entry[len(entry)-2] ^= 0xff
+			return append(data, entry...)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			q := openTestQueue(t, dir, durableQueueOptions{})
+			appendRecords(t, q, []string{"a"}, []string{"b"})
+			q.Close()
+
+			damageTail(t, dir, tt.damage)
+
+			q = openTestQueue(t, dir, durableQueueOptions{})
+			if n := q.Len(); n != 2 {
+				t.Fatalf("Len() = %d after recovery, want 2", n)
+			}
+			// The damaged entry is cut off, so the next append follows on
+			// from the last good one.
+			if offset, err := q.Append([]string{"d"}); err != nil || offset != 2 {
+				t.Fatalf("Append = %d, %v, want offset 2", offset, err)
+			}
+
+			c, err := q.Consumer("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			q.Close()
+
+			offsets, records := readAll(t, c)
+			if want := []uint64{0, 1, 2}; !reflect.DeepEqual(offsets, want) {
+				t.Fatalf("offsets %v, want %v", offsets, want)
+			}
+			if want := [][]string{{"a"}, {"b"}, {"d"}}; !reflect.DeepEqual(records, want) {
+				t.Fatalf("records %v, want %v", records, want)
+			}
+		})
+	}
+}
+
+func TestDurableQueueResume(t *testing.T) {
+	dir := t.TempDir()
+	// A segment per entry, so resuming has to find the right one.
+	opts := durableQueueOptions{SegmentSize: 1}
+
+	q := openTestQueue(t, dir, opts)
+	for i := 0; i < 5; i++ {
+		appendRecords(t, q, []string{strconv.Itoa(i)})
+	}
+	c, err := q.Consumer("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, _, err := c.Next(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Entry 2 was read but not acked, so it is delivered again.
+	if err := c.Ack(1); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	q.Close()
+
+	q = openTestQueue(t, dir, opts)
+	c, err = q.Consumer("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if n := c.Committed(); n != 2 {
+		t.Fatalf("Committed() = %d after reopening, want 2", n)
+	}
+	q.Close()
+
+	offsets, records := readAll(t, c)
+	if want := []uint64{2, 3, 4}; !reflect.DeepEqual(offsets, want) {
+		t.Fatalf("offsets %v, want %v", offsets, want)
+	}
+	if want := [][]string{{"2"}, {"3"}, {"4"}}; !reflect.DeepEqual(records, want) {
+		t.Fatalf("records %v, want %v", records, want)
+	}
+}
+
+func TestDurableQueueCompact(t *testing.T) {
+	dir := t.TempDir()
+	q := openTestQueue(t, dir, durableQueueOptions{SegmentSize: 1})
+	defer q.Close()
+	for i := 0; i < 10; i++ {
+		appendRecords(t, q, []string{strconv.Itoa(i)})
+	}
+
+	fast, err := q.Consumer("fast")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	slow, err := q.Consumer("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fast.Ack(6)
+	slow.Ack(2)
+
+	// Only what the slow consumer has acked, entries 0 to 2, may go.
+	if n, err := q.Compact(); err != nil || n != 3 {
+		t.Fatalf("Compact = %d, %v, want 3 segments removed", n, err)
+	}
+	for base := uint64(0); base < 10; base++ {
+		_, err := os.Stat(filepath.Join(dir, segmentName(base)))
+		if exists := err == nil; exists != (base >= 3) {
+			t.Fatalf("segment %d: exists %v, want %v", base, exists, base >= 3)
+		}
+	}
+
+	// The slow consumer carries on from where it acked.
+	slow.Close()
+	slow, err = q.Consumer("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	offset, record, err := slow.Next(context.Background())
+	if err != nil || offset != 3 || !reflect.DeepEqual(record, []string{"3"}) {
+		t.Fatalf("Next = %d, %v, %v, want 3, [3]", offset, record, err)
+	}
+
+	slow.Ack(8)
+	if n, err := q.Compact(); err != nil || n != 4 {
+		t.Fatalf("Compact = %d, %v, want 4 segments removed", n, err)
+	}
+}
+
+func TestDurableStageLeavesQueueOpen(t *testing.T) {
+	q := openTestQueue(t, t.TempDir(), durableQueueOptions{Sync: syncNever})
+	defer q.Close()
+
+	in := make(chan []string)
+	go func() {
+		defer close(in)
+		for i := 0; i < 3; i++ {
+			in <- []string{strconv.Itoa(i)}
+		}
+	}()
+
+	out, errc := durableStage(context.Background(), in, q, "test")
+	var got [][]string
+	for r := range out {
+		got = append(got, r)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{{"0"}, {"1"}, {"2"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if _, err := q.Append([]string{"3"}); err != nil {
+		t.Fatalf("queue unusable after the stage finished: %v", err)
+	}
+	c, err := q.Consumer("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if n := c.Committed(); n != 3 {
+		t.Fatalf("Committed() = %d, want 3", n)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+type externalSortOptions struct {
+	Keys []sortKey
+
+	// MemoryLimit is roughly how many bytes of records are held before they
+	// are sorted and spilled to a run file. Up to Workers+1 buffers of this
+	// size may be in memory at once. Defaults to 64MB.
+	MemoryLimit int
+
+	// Workers is how many runs are sorted and written in parallel. Defaults
+	// to the number of CPUs.
+	Workers int
+
+	// TempDir is where run files go, os.TempDir() if empty.
+	TempDir string
+}
+
+// recordSize estimates the memory held by a record: the string bytes plus
+// the string and slice headers.
+func recordSize(record []string) int {
+	size := 24
+	for _, f := range record {
+		size += 16 + len(f)
+	}
+	return size
+}
+
+// externalSort sorts every record of in by opts.Keys, using temporary files
+// when the records don't fit within opts.MemoryLimit. The sort is stable.
+// Records are only sent once in is closed. The error channel receives at most
+// one error, ctx.Err() if the sort was cancelled, and is closed together with
+// the records channel; run files are removed by then.
+func externalSort(ctx context.Context, in <-chan []string, opts externalSortOptions) (<-chan []string, <-chan error) {
+	if opts.MemoryLimit <= 0 {
+		opts.MemoryLimit = 64 << 20
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+
+	less := byKeys(opts.Keys...)
+	out := make(chan []string)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+
+		parent := ctx
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		var (
+			errMu    sync.Mutex
+			firstErr error
+		)
+		fail := func(err error) {
+			errMu.Lock()
+			defer errMu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		}
+		defer func() {
+			errMu.Lock()
+			defer errMu.Unlock()
+			if firstErr == nil {
+				firstErr = parent.Err()
+			}
+			if firstErr != nil {
+				errc <- firstErr
+			}
+		}()
+
+		sortRecords := func(records [][]string) {
+			sort.SliceStable(records, func(i, j int) bool {
+				return less(records[i], records[j])
+			})
+		}
+
+		send := func(record []string) bool {
+			select {
+			case out <- record:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		var (
+			dir  string
+			runs []string
+			wg   sync.WaitGroup
+			sem  = make(chan struct{}, opts.Workers)
+		)
+		defer func() {
+			wg.Wait()
+			if dir != "" {
+				os.RemoveAll(dir)
+			}
+		}()
+
+		spill := func(records [][]string) {
+			if dir == "" {
+				var err error
+				dir, err = os.MkdirTemp(opts.TempDir, "extsort-")
+				if err != nil {
+					fail(fmt.Errorf("creating sort directory: %w", err))
+					return
+				}
+			}
+
+			path := filepath.Join(dir, fmt.Sprintf("run-%06d.csv", len(runs)))
+			runs = append(runs, path)
+
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+
+				sortRecords(records)
+				if err := writeRun(path, records); err != nil {
+					fail(err)
+				}
+			}()
+		}
+
+		var (
+			buffer [][]string
+			size   int
+		)
+
+	collect:
+		for {
+			select {
+			case record, ok := <-in:
+				if !ok {
+					break collect
+				}
+				buffer = append(buffer, record)
+				size += recordSize(record)
+				if size >= opts.MemoryLimit {
+					spill(buffer)
+					buffer, size = nil, 0
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		// Everything fitted in memory, no need to touch the disk.
+		if len(runs) == 0 {
+			sortRecords(buffer)
+			for _, record := range buffer {
+				if !send(record) {
+					return
+				}
+			}
+			return
+		}
+
+		if len(buffer) > 0 {
+			spill(buffer)
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			return
+		}
+
+		readers := make([]<-chan []string, len(runs))
+		for i, path := range runs {
+			readers[i] = readRun(ctx, path, fail)
+		}
+
+		// mergeSorted breaks ties by input order and runs are numbered in
+		// arrival order, which keeps the whole sort stable.
+		for record := range mergeSorted(ctx, less, readers...) {
+			if !send(record) {
+				return
+			}
+		}
+	}()
+
+	return out, errc
+}
+
+func writeRun(path string, records [][]string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating sort run: %w", err)
+	}
+
+	bw := bufio.NewWriterSize(f, 1<<20)
+	cw := csv.NewWriter(bw)
+	if err := cw.WriteAll(records); err != nil {
+		f.Close()
+		return fmt.Errorf("writing sort run: %w", err)
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("writing sort run: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing sort run: %w", err)
+	}
+	return nil
+}
+
+func readRun(ctx context.Context, path string, fail func(error)) <-chan []string {
+	ch := make(chan []string)
+
+	go func() {
+		defer close(ch)
+
+		f, err := os.Open(path)
+		if err != nil {
+			fail(fmt.Errorf("opening sort run: %w", err))
+			return
+		}
+		defer f.Close()
+
+		cr := csv.NewReader(bufio.NewReaderSize(f, 1<<20))
+		cr.FieldsPerRecord = -1
+		for {
+			record, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				fail(fmt.Errorf("reading sort run: %w", err))
+				return
+			}
+
+			select {
+			case ch <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch
+}
+
+// externalSortFile sorts in like externalSort and writes the result as CSV
+// to path. The file only appears once the whole sort has succeeded.
+func externalSortFile(ctx context.Context, in <-chan []string, path string, opts externalSortOptions) error {
+	w, err := createRecordFile(path, sinkOptions{})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	sorted, errc := externalSort(ctx, in, opts)
+
+	for record := range sorted {
+		if err := w.Write(record); err != nil {
+			w.Abort()
+			cancel()
+			for range sorted {
+			}
+			return err
+		}
+	}
+	if err := <-errc; err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Commit()
+}
+
+// externalSortExample sorts both CSV files together on their second column
+// with a memory limit small enough to force several runs.
+func externalSortExample() {
+	file1, err := read("file1.csv")
+	if err != nil {
+		panic(err)
+	}
+	file2, err := read("file2.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	sorted, errc := externalSort(context.Background(), merge(file1, file2), externalSortOptions{
+		Keys:        []sortKey{{Col: 1}},
+		MemoryLimit: 512,
+		Workers:     2,
+	})
+	for v := range sorted {
+		fmt.Println(v)
+	}
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+}
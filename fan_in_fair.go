@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+)
+
+// PriorityInput is an input to mergePriority. Higher Priority wins.
+type PriorityInput struct {
+	C        <-chan []string
+	Priority int
+}
+
+// WeightedInput is an input to mergeWeighted. Over time each input gets a
+// share of the output proportional to its Weight.
+type WeightedInput struct {
+	C      <-chan []string
+	Weight int
+}
+
+// MergeStats counts what a fair merge did for each of its inputs, in the
+// order the inputs were given.
+type MergeStats struct {
+	forwarded []uint64
+	promoted  []uint64
+}
+
+func newMergeStats(n int) *MergeStats {
+	return &MergeStats{
+		forwarded: make([]uint64, n),
+		promoted:  make([]uint64, n),
+	}
+}
+
+// Forwarded returns how many items of input i reached the output.
+func (s *MergeStats) Forwarded(i int) uint64 {
+	return atomic.LoadUint64(&s.forwarded[i])
+}
+
+// Promoted returns how many items of input i were sent ahead of their
+// priority by starvation protection.
+func (s *MergeStats) Promoted(i int) uint64 {
+	return atomic.LoadUint64(&s.promoted[i])
+}
+
+// mergePriority is merge where a waiting item from a higher priority input is
+// always sent before one from a lower priority input. To keep a busy input
+// from shutting the others out entirely, an input that has had an item
+// waiting while maxSkips items went past it is served next regardless of
+// priority. A maxSkips of zero disables that protection.
+func mergePriority(ctx context.Context, maxSkips int, inputs ...PriorityInput) (<-chan []string, *MergeStats) {
+	chans := make([]<-chan []string, len(inputs))
+	for i, in := range inputs {
+		chans[i] = in.C
+	}
+
+	stats := newMergeStats(len(inputs))
+	skipped := make([]int, len(inputs))
+
+	pick := func(heads [][]string, ready []bool) int {
+		best, starved := -1, -1
+		for i := range inputs {
+			if !ready[i] {
+				continue
+			}
+			if best == -1 || inputs[i].Priority > inputs[best].Priority {
+				best = i
+			}
+			if maxSkips > 0 && skipped[i] >= maxSkips && (starved == -1 || skipped[i] > skipped[starved]) {
+				starved = i
+			}
+		}
+
+		chosen := best
+		if starved != -1 && inputs[starved].Priority < inputs[best].Priority {
+			chosen = starved
+			atomic.AddUint64(&stats.promoted[chosen], 1)
+		}
+
+		for i := range inputs {
+			if i == chosen {
+				skipped[i] = 0
+			} else if ready[i] {
+				skipped[i]++
+			}
+		}
+		return chosen
+	}
+
+	return runFairMerge(ctx, chans, stats, pick), stats
+}
+
+// mergeWeighted is merge with deficit round-robin scheduling. Each round an
+// input earns credit equal to its weight, and spends it sending items; cost
+// says how much credit an item uses. A nil cost charges one per item, which
+// makes this a plain weighted round-robin. Every input with a positive weight
+// is served each round, so none can starve.
+func mergeWeighted(ctx context.Context, cost func([]string) int, inputs ...WeightedInput) (<-chan []string, *MergeStats) {
+	if cost == nil {
+		cost = func([]string) int { return 1 }
+	}
+
+	chans := make([]<-chan []string, len(inputs))
+	for i, in := range inputs {
+		chans[i] = in.C
+	}
+
+	stats := newMergeStats(len(inputs))
+	deficit := make([]int, len(inputs))
+	current, arrived := 0, false
+
+	pick := func(heads [][]string, ready []bool) int {
+		for {
+			if !arrived {
+				arrived = true
+				if ready[current] {
+					weight := inputs[current].Weight
+					if weight < 1 {
+						weight = 1
+					}
+					deficit[current] += weight
+				}
+			}
+
+			if ready[current] {
+				if c := cost(heads[current]); deficit[current] >= c {
+					deficit[current] -= c
+					return current
+				}
+			} else {
+				// Credit isn't banked by inputs that have nothing to send.
+				deficit[current] = 0
+			}
+
+			current = (current + 1) % len(inputs)
+			arrived = false
+		}
+	}
+
+	return runFairMerge(ctx, chans, stats, pick), stats
+}
+
+// runFairMerge keeps at most one item waiting per input and asks pick which
+// of the waiting items to send next. pick is only called when at least one
+// input has an item ready.
+func runFairMerge(ctx context.Context, chans []<-chan []string, stats *MergeStats, pick func(heads [][]string, ready []bool) int) <-chan []string {
+	out := make(chan []string)
+
+	go func() {
+		defer close(out)
+
+		heads := make([][]string, len(chans))
+		ready := make([]bool, len(chans))
+		open := make([]bool, len(chans))
+		for i := range open {
+			open[i] = true
+		}
+
+		receive := func(i int, v []string, ok bool) {
+			if !ok {
+				open[i] = false
+				return
+			}
+			heads[i], ready[i] = v, true
+		}
+
+		for {
+			anyReady, anyOpen := false, false
+			for i, c := range chans {
+				if open[i] && !ready[i] {
+					select {
+					case v, ok := <-c:
+						receive(i, v, ok)
+					default:
+					}
+				}
+				anyReady = anyReady || ready[i]
+				anyOpen = anyOpen || open[i]
+			}
+
+			if !anyReady {
+				if !anyOpen {
+					return
+				}
+
+				// Nothing is waiting; block until any input produces.
+				cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())}}
+				index := []int{-1}
+				for i, c := range chans {
+					if open[i] {
+						cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(c)})
+						index = append(index, i)
+					}
+				}
+				chosen, v, ok := reflect.Select(cases)
+				if chosen == 0 {
+					return
+				}
+				if ok {
+					receive(index[chosen], v.Interface().([]string), true)
+				} else {
+					receive(index[chosen], nil, false)
+				}
+				continue
+			}
+
+			i := pick(heads, ready)
+			select {
+			case out <- heads[i]:
+				atomic.AddUint64(&stats.forwarded[i], 1)
+				heads[i], ready[i] = nil, false
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// priorityMergeExample merges both CSV files with file1 as the high priority
+// feed, and then again weighted three to one in file1's favour.
+func priorityMergeExample() {
+	ctx := context.Background()
+
+	file1, err := read("file1.csv")
+	if err != nil {
+		panic(err)
+	}
+	file2, err := read("file2.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	merged, stats := mergePriority(ctx, 4,
+		PriorityInput{C: file1, Priority: 10},
+		PriorityInput{C: file2, Priority: 1},
+	)
+	for v := range merged {
+		fmt.Println(v)
+	}
+	fmt.Println("file1:", stats.Forwarded(0), "file2:", stats.Forwarded(1), "promoted:", stats.Promoted(1))
+
+	file1, err = read("file1.csv")
+	if err != nil {
+		panic(err)
+	}
+	file2, err = read("file2.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	merged, stats = mergeWeighted(ctx, nil,
+		WeightedInput{C: file1, Weight: 3},
+		WeightedInput{C: file2, Weight: 1},
+	)
+	for v := range merged {
+		fmt.Println(v)
+	}
+	fmt.Println("file1:", stats.Forwarded(0), "file2:", stats.Forwarded(1))
+}
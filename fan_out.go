@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
 )
 
 func fanOutMain() {
@@ -14,31 +15,13 @@ func fanOutMain() {
 		panic(err)
 	}
 
-	br1 := fanOut("1", ch)
-	br2 := fanOut("2", ch)
-	br3 := fanOut("3", ch)
-
-	for {
-		if br1 == nil && br2 == nil && br3 == nil {
-			break
-		}
-
-		select {
-		case _, ok := <-br1:
-			if !ok {
-				br1 = nil
-			}
-		case _, ok := <-br2:
-			if !ok {
-				br2 = nil
-			}
-		case _, ok := <-br3:
-			if !ok {
-				br3 = nil
-			}
-		}
+	workers := make([]<-chan struct{}, 3)
+	for i := range workers {
+		workers[i] = fanOut(strconv.Itoa(i+1), ch)
 	}
 
+	<-allClosed(workers...)
+
 	fmt.Println("\nAll complete")
 }
 
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+type joinKind int
+
+const (
+	innerJoin joinKind = iota
+	leftJoin
+	fullOuterJoin
+)
+
+type joinOptions struct {
+	Kind joinKind
+
+	// LeftKey and RightKey are the key columns of each side, compared
+	// pairwise.
+	LeftKey, RightKey []int
+
+	// LeftWidth and RightWidth are how many empty fields stand in for a
+	// missing side in outer joins. When zero the width of the first record
+	// seen on that side is used.
+	LeftWidth, RightWidth int
+
+	// Numeric compares keys as numbers in mergeJoin, matching a sort with
+	// sortKey.Numeric set.
+	Numeric bool
+}
+
+// joiner holds what hashJoin and mergeJoin share: the output channel and the
+// padding for missing sides.
+type joiner struct {
+	ctx  context.Context
+	out  chan []string
+	opts joinOptions
+}
+
+func (j *joiner) seen(left, right []string) {
+	if left != nil && j.opts.LeftWidth == 0 {
+		j.opts.LeftWidth = len(left)
+	}
+	if right != nil && j.opts.RightWidth == 0 {
+		j.opts.RightWidth = len(right)
+	}
+}
+
+// emit sends left and right as one record. A nil side is padded with empty
+// fields.
+func (j *joiner) emit(left, right []string) bool {
+	if left == nil {
+		left = make([]string, j.opts.LeftWidth)
+	}
+	if right == nil {
+		right = make([]string, j.opts.RightWidth)
+	}
+
+	combined := make([]string, 0, len(left)+len(right))
+	combined = append(combined, left...)
+	combined = append(combined, right...)
+
+	select {
+	case j.out <- combined:
+		return true
+	case <-j.ctx.Done():
+		return false
+	}
+}
+
+func (j *joiner) receive(c <-chan []string) ([]string, bool, bool) {
+	select {
+	case record, ok := <-c:
+		return record, ok, true
+	case <-j.ctx.Done():
+		return nil, false, false
+	}
+}
+
+// hashJoin joins left and right on their key columns by loading all of right
+// into memory first, so right should be the smaller side. Output follows the
+// order of left; for a full outer join the right records that never matched
+// come last.
+func hashJoin(ctx context.Context, left, right <-chan []string, opts joinOptions) <-chan []string {
+	j := &joiner{ctx: ctx, out: make(chan []string), opts: opts}
+	leftKey, rightKey := columnKey(opts.LeftKey...), columnKey(opts.RightKey...)
+
+	go func() {
+		defer close(j.out)
+
+		type entry struct {
+			record  []string
+			matched bool
+		}
+		table := make(map[string][]*entry)
+		var order []*entry
+
+		for {
+			record, ok, alive := j.receive(right)
+			if !alive {
+				return
+			}
+			if !ok {
+				break
+			}
+			j.seen(nil, record)
+			e := &entry{record: record}
+			table[rightKey(record)] = append(table[rightKey(record)], e)
+			order = append(order, e)
+		}
+
+		for {
+			record, ok, alive := j.receive(left)
+			if !alive {
+				return
+			}
+			if !ok {
+				break
+			}
+			j.seen(record, nil)
+
+			matches := table[leftKey(record)]
+			for _, e := range matches {
+				e.matched = true
+				if !j.emit(record, e.record) {
+					return
+				}
+			}
+			if len(matches) == 0 && opts.Kind != innerJoin {
+				if !j.emit(record, nil) {
+					return
+				}
+			}
+		}
+
+		if opts.Kind == fullOuterJoin {
+			for _, e := range order {
+				if !e.matched && !j.emit(nil, e.record) {
+					return
+				}
+			}
+		}
+	}()
+
+	return j.out
+}
+
+// mergeJoin joins left and right on their key columns, both of which must
+// already be sorted by those columns (see externalSort). Only one run of
+// equal right keys is held in memory at a time.
+func mergeJoin(ctx context.Context, left, right <-chan []string, opts joinOptions) <-chan []string {
+	j := &joiner{ctx: ctx, out: make(chan []string), opts: opts}
+
+	compare := func(l, r []string) int {
+		for i := range opts.LeftKey {
+			if c := compareField(l[opts.LeftKey[i]], r[opts.RightKey[i]], opts.Numeric); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+	sameRight := func(a, b []string) bool {
+		for _, col := range opts.RightKey {
+			if compareField(a[col], b[col], opts.Numeric) != 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	go func() {
+		defer close(j.out)
+
+		l, lok, alive := j.receive(left)
+		if !alive {
+			return
+		}
+		r, rok, alive := j.receive(right)
+		if !alive {
+			return
+		}
+		j.seen(l, r)
+
+		advanceLeft := func() bool {
+			l, lok, alive = j.receive(left)
+			j.seen(l, nil)
+			return alive
+		}
+		advanceRight := func() bool {
+			r, rok, alive = j.receive(right)
+			j.seen(nil, r)
+			return alive
+		}
+
+		for lok || rok {
+			switch {
+			case !rok || (lok && compare(l, r) < 0):
+				if opts.Kind != innerJoin && !j.emit(l, nil) {
+					return
+				}
+				if !advanceLeft() {
+					return
+				}
+
+			case !lok || compare(l, r) > 0:
+				if opts.Kind == fullOuterJoin && !j.emit(nil, r) {
+					return
+				}
+				if !advanceRight() {
+					return
+				}
+
+			default:
+				group := [][]string{r}
+				for {
+					if !advanceRight() {
+						return
+					}
+					if !rok || !sameRight(group[0], r) {
+						break
+					}
+					group = append(group, r)
+				}
+
+				for lok && compare(l, group[0]) == 0 {
+					for _, g := range group {
+						if !j.emit(l, g) {
+							return
+						}
+					}
+					if !advanceLeft() {
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return j.out
+}
+
+// joinExample joins file1 and file2 on their last column, in memory and then
+// again after sorting both sides.
+func joinExample() {
+	ctx := context.Background()
+	opts := joinOptions{Kind: fullOuterJoin, LeftKey: []int{3}, RightKey: []int{3}}
+
+	file1, err := read("file1.csv")
+	if err != nil {
+		panic(err)
+	}
+	file2, err := read("file2.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	for v := range hashJoin(ctx, file1, file2, opts) {
+		fmt.Println(v)
+	}
+
+	sorted := func(filename string) <-chan []string {
+		ch, err := read(filename)
+		if err != nil {
+			panic(err)
+		}
+		// The error channel is buffered, so it can be left unread here.
+		out, _ := externalSort(ctx, ch, externalSortOptions{Keys: []sortKey{{Col: 3}}})
+		return out
+	}
+
+	opts.Kind = innerJoin
+	for v := range mergeJoin(ctx, sorted("file1.csv"), sorted("file2.csv"), opts) {
+		fmt.Println(v)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// LimitAlgorithm decides the next concurrency limit from the outcome of a
+// single item. rtt is how long the item took, inflight how many items were
+// running when it started, and dropped whether it failed. Update is called
+// with the limiter's lock held, so implementations may keep state unguarded.
+type LimitAlgorithm interface {
+	Update(limit int, rtt time.Duration, inflight int, dropped bool) int
+}
+
+// AIMDLimit grows the limit by one for every successful item that kept the
+// limiter busy, and multiplies it by Backoff on an error or an item slower
+// than Timeout.
+type AIMDLimit struct {
+	Min, Max int
+	Backoff  float64       // defaults to 0.9
+	Timeout  time.Duration // zero means only errors back off
+}
+
+func (a *AIMDLimit) Update(limit int, rtt time.Duration, inflight int, dropped bool) int {
+	backoff := a.Backoff
+	if backoff <= 0 || backoff >= 1 {
+		backoff = 0.9
+	}
+
+	switch {
+	case dropped || (a.Timeout > 0 && rtt > a.Timeout):
+		// Items started above the current limit were admitted before the
+		// last backoff and have already been accounted for.
+		if inflight <= limit {
+			limit = int(float64(limit) * backoff)
+		}
+	case inflight*2 >= limit:
+		// Only grow when the current limit is actually being used.
+		limit++
+	}
+	return clampLimit(limit, a.Min, a.Max)
+}
+
+// GradientLimit compares the latency of each item with the lowest latency
+// seen, which stands in for the latency without any queueing. While they
+// agree the limit grows by roughly its square root, and once items start
+// queueing the ratio between the two shrinks it.
+type GradientLimit struct {
+	Min, Max  int
+	Tolerance float64 // how much slower than the minimum is still fine, defaults to 1.5
+	Smoothing float64 // weight of the new limit, defaults to 0.2
+
+	minRTT    time.Duration
+	hasMinRTT bool
+	limit     float64
+}
+
+func (g *GradientLimit) Update(limit int, rtt time.Duration, inflight int, dropped bool) int {
+	tolerance, smoothing := g.Tolerance, g.Smoothing
+	if tolerance < 1 {
+		tolerance = 1.5
+	}
+	if smoothing <= 0 || smoothing > 1 {
+		smoothing = 0.2
+	}
+	if g.limit == 0 {
+		g.limit = float64(limit)
+	}
+	if rtt <= 0 && !dropped {
+		// A zero latency is a clock problem, not a measurement.
+		return limit
+	}
+	if rtt > 0 && (!g.hasMinRTT || rtt < g.minRTT) {
+		g.minRTT, g.hasMinRTT = rtt, true
+	}
+
+	if inflight*2 < limit && !dropped {
+		// An idle limiter tells us nothing about how far it can be pushed.
+		return limit
+	}
+
+	gradient := math.Max(0.5, math.Min(1, tolerance*float64(g.minRTT)/float64(rtt)))
+	if dropped {
+		gradient = 0.5
+	}
+	next := g.limit*gradient + math.Sqrt(g.limit)
+	g.limit = clampLimitFloat(g.limit*(1-smoothing)+next*smoothing, g.Min, g.Max)
+
+	return int(g.limit)
+}
+
+// VegasLimit estimates the queue behind the limiter from the ratio between
+// the lowest latency seen and the current latency, as TCP Vegas does, and
+// keeps it between Alpha and Beta items.
+type VegasLimit struct {
+	Min, Max    int
+	Alpha, Beta int // defaults to 3 and 6
+
+	minRTT    time.Duration
+	hasMinRTT bool
+}
+
+func (v *VegasLimit) Update(limit int, rtt time.Duration, inflight int, dropped bool) int {
+	alpha, beta := v.Alpha, v.Beta
+	if alpha <= 0 {
+		alpha = 3
+	}
+	if beta <= alpha {
+		beta = 2 * alpha
+	}
+
+	if rtt <= 0 && !dropped {
+		// A zero latency is a clock problem, not a measurement.
+		return limit
+	}
+	if rtt > 0 && (!v.hasMinRTT || rtt < v.minRTT) {
+		v.minRTT, v.hasMinRTT = rtt, true
+	}
+
+	if dropped {
+		return clampLimit(limit-int(math.Log10(float64(limit)+1))-1, v.Min, v.Max)
+	}
+	if inflight*2 < limit {
+		return limit
+	}
+
+	queue := int(math.Ceil(float64(limit) * (1 - float64(v.minRTT)/float64(rtt))))
+	switch {
+	case queue < alpha:
+		limit++
+	case queue > beta:
+		limit--
+	}
+	return clampLimit(limit, v.Min, v.Max)
+}
+
+func clampLimit(limit, min, max int) int {
+	if min < 1 {
+		min = 1
+	}
+	if max > 0 && limit > max {
+		limit = max
+	}
+	if limit < min {
+		limit = min
+	}
+	return limit
+}
+
+func clampLimitFloat(limit float64, min, max int) float64 {
+	if min < 1 {
+		min = 1
+	}
+	if math.IsNaN(limit) {
+		return float64(min)
+	}
+	if max > 0 && limit > float64(max) {
+		return float64(max)
+	}
+	if limit < float64(min) {
+		return float64(min)
+	}
+	return limit
+}
+
+// AdaptiveLimiter bounds the number of items in flight and lets a
+// LimitAlgorithm move that bound as latency and errors change.
+type AdaptiveLimiter struct {
+	cond     *CtxCond
+	algo     LimitAlgorithm
+	limit    int
+	inflight int
+
+	current int64 // limit, readable without the lock
+}
+
+func NewAdaptiveLimiter(initial int, algo LimitAlgorithm) *AdaptiveLimiter {
+	if initial < 1 {
+		initial = 1
+	}
+	return &AdaptiveLimiter{
+		cond:    NewCtxCond(&sync.Mutex{}),
+		algo:    algo,
+		limit:   initial,
+		current: int64(initial),
+	}
+}
+
+// Limit returns the current concurrency limit.
+func (l *AdaptiveLimiter) Limit() int {
+	return int(atomic.LoadInt64(&l.current))
+}
+
+// Acquire waits for a free slot. The returned release must be called exactly
+// once when the item is finished, with the error it failed with, if any.
+func (l *AdaptiveLimiter) Acquire(ctx context.Context) (release func(err error), err error) {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+
+	err = l.cond.WaitFor(ctx, func() bool {
+		return l.inflight < l.limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l.inflight++
+	inflight := l.inflight
+	start := time.Now()
+
+	var once sync.Once
+	return func(err error) {
+		once.Do(func() {
+			rtt := time.Since(start)
+
+			l.cond.L.Lock()
+			defer l.cond.L.Unlock()
+
+			l.inflight--
+			// Cancellation is not the downstream's fault, so it doesn't count
+			// as a drop.
+			dropped := err != nil && !errors.Is(err, context.Canceled)
+			l.limit = l.algo.Update(l.limit, rtt, inflight, dropped)
+			atomic.StoreInt64(&l.current, int64(l.limit))
+			l.cond.Broadcast()
+		})
+	}, nil
+}
+
+// LimitStage applies fn to every item of in, running as many at once as the
+// limiter allows. Items come out in completion order. Items whose fn fails are
+// passed to onError, if it is not nil, and dropped from the output. If ctx
+// ends, the rest of in is drained, without calling fn, so the stages before
+// this one can finish.
+func LimitStage[In, Out any](
+	ctx context.Context,
+	l *AdaptiveLimiter,
+	in <-chan In,
+	fn func(context.Context, In) (Out, error),
+	onError func(In, error),
+) <-chan Out {
+	out := make(chan Out)
+
+	go func() {
+		var wg sync.WaitGroup
+		defer func() {
+			wg.Wait()
+			close(out)
+		}()
+
+		for item := range in {
+			if ctx.Err() != nil {
+				break
+			}
+			release, err := l.Acquire(ctx)
+			if err != nil {
+				break
+			}
+
+			wg.Add(1)
+			go func(item In) {
+				defer wg.Done()
+
+				res, err := fn(ctx, item)
+				release(err)
+				if err != nil {
+					if onError != nil {
+						onError(item, err)
+					}
+					return
+				}
+
+				select {
+				case out <- res:
+				case <-ctx.Done():
+				}
+			}(item)
+		}
+		for range in {
+		}
+	}()
+
+	return out
+}
+
+// adaptiveFanOutExample runs a fake service whose latency grows once more
+// than eight calls overlap, and shows each algorithm settling near that.
+func adaptiveFanOutExample() {
+	algorithms := []struct {
+		name string
+		algo LimitAlgorithm
+	}{
+		{"aimd", &AIMDLimit{Max: 64, Timeout: 15 * time.Millisecond}},
+		{"gradient", &GradientLimit{Max: 64}},
+		{"vegas", &VegasLimit{Max: 64}},
+	}
+
+	for _, a := range algorithms {
+		var active int64
+		service := func(ctx context.Context, i int) (int, error) {
+			n := atomic.AddInt64(&active, 1)
+			defer atomic.AddInt64(&active, -1)
+
+			delay := 5 * time.Millisecond
+			if n > 8 {
+				delay += time.Duration(n-8) * 2 * time.Millisecond
+			}
+			time.Sleep(delay)
+			return i, nil
+		}
+
+		numbers := make([]int, 2000)
+		for i := range numbers {
+			numbers[i] = i
+		}
+
+		done := make(chan interface{})
+		l := NewAdaptiveLimiter(1, a.algo)
+		start := time.Now()
+		processed := 0
+		for range LimitStage(context.Background(), l, generator(done, numbers...), service, nil) {
+			processed++
+		}
+		close(done)
+
+		fmt.Printf("%-8s processed %d in %s, final limit %d\n", a.name, processed, time.Since(start).Round(time.Millisecond), l.Limit())
+	}
+}
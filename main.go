@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `usage:
+  concurrency_in_go dlq run    [-pipeline name] [-file path] input.csv
+  concurrency_in_go dlq list   [-file path] [filters]
+  concurrency_in_go dlq replay -pipeline name [-file path] [filters]
+
+run reads input.csv through the pipeline, sanitize,titleCase by default,
+and prints the output; rows that can't be read go to the dead letter file.
+
+filters:
+  -stage name     only entries from this stage
+  -source file    only entries from this source file
+  -match text     only entries whose error contains text
+  -since time     only entries at or after this RFC 3339 time
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "dlq":
+		err = dlqCommand(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func dlqCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("dlq: missing command\n%s", usage)
+	}
+
+	fs := flag.NewFlagSet("dlq "+args[0], flag.ContinueOnError)
+	file := fs.String("file", "dead_letters.jsonl", "dead letter file")
+	pipeline := fs.String("pipeline", "", "pipeline to run or replay through")
+
+	if args[0] == "run" {
+		// run writes dead letters rather than reading them, so it has no
+		// filters.
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("dlq run: want one input file\n%s", usage)
+		}
+		if *pipeline == "" {
+			*pipeline = "sanitize,titleCase"
+		}
+		return dlqRun(fs.Arg(0), *file, *pipeline)
+	}
+
+	stage := fs.String("stage", "", "only entries from this stage")
+	source := fs.String("source", "", "only entries from this source file")
+	match := fs.String("match", "", "only entries whose error contains this")
+	since := fs.String("since", "", "only entries at or after this RFC 3339 time")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	filter := deadLetterFilter{Stage: *stage, Source: *source, Match: *match}
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return fmt.Errorf("dlq: -since: %w", err)
+		}
+		filter.Since = t
+	}
+
+	letters, err := readDeadLetters(*file, filter)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		for _, d := range letters {
+			where := d.Source
+			switch {
+			case d.Line > 0:
+				where = fmt.Sprintf("%s:%d", d.Source, d.Line)
+			case d.Index > 0:
+				where = fmt.Sprintf("%s#%d", d.Source, d.Index)
+			}
+			fmt.Printf("%s  %-10s %-20s %s  %s\n", d.Time.Format(time.RFC3339), d.Stage, where, d.Error, recordText(d))
+		}
+		fmt.Printf("%d entries\n", len(letters))
+		return nil
+
+	case "replay":
+		if *pipeline == "" {
+			return fmt.Errorf("dlq replay: -pipeline is required")
+		}
+		out, err := replayDeadLetters(context.Background(), letters, *pipeline)
+		if err != nil {
+			return err
+		}
+		for v := range out {
+			fmt.Println(v)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("dlq: unknown command %q\n%s", args[0], usage)
+}
+
+// dlqRun reads input through the named replay pipeline, printing what comes
+// out and sending unreadable rows to the dead letter file.
+func dlqRun(input, file, pipeline string) error {
+	stage, ok := replayPipelines[pipeline]
+	if !ok {
+		return fmt.Errorf("dlq run: unknown pipeline %q", pipeline)
+	}
+
+	dlq, err := openDeadLetterQueue(file, false)
+	if err != nil {
+		return err
+	}
+	defer dlq.Close()
+
+	ch, errc := readCSVDeadLetter(input, dlq)
+	for v := range stage(ch) {
+		fmt.Println(v)
+	}
+	return <-errc
+}
+
+// recordText is how list shows the row of a dead letter.
+func recordText(d deadLetter) string {
+	if len(d.Record) == 0 && d.Raw != "" {
+		return d.Raw
+	}
+	return strings.Join(d.Record, ",")
+}
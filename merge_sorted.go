@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// recordLess reports whether record a sorts before record b.
+type recordLess func(a, b []string) bool
+
+// sortKey is one column of a sort order. Numeric columns are compared as
+// numbers, with values that don't parse as numbers sorting after all of those
+// that do.
+type sortKey struct {
+	Col     int
+	Numeric bool
+	Desc    bool
+}
+
+// byColumn orders records by a single column.
+func byColumn(col int, numeric bool) recordLess {
+	return byKeys(sortKey{Col: col, Numeric: numeric})
+}
+
+// byKeys orders records by the first key, then the second on a tie, and so on.
+func byKeys(keys ...sortKey) recordLess {
+	return func(a, b []string) bool {
+		for _, k := range keys {
+			c := compareField(a[k.Col], b[k.Col], k.Numeric)
+			if k.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	}
+}
+
+func compareField(a, b string, numeric bool) int {
+	if numeric {
+		x, errA := strconv.ParseFloat(a, 64)
+		y, errB := strconv.ParseFloat(b, 64)
+		switch {
+		case errA == nil && errB == nil:
+			switch {
+			case x < y:
+				return -1
+			case x > y:
+				return 1
+			}
+			return 0
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		}
+	}
+
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+type mergeItem struct {
+	record []string
+	source int
+}
+
+// mergeHeap is a min-heap of the next record from each input. Records that
+// compare equal come out in input order, which keeps the merge deterministic.
+type mergeHeap struct {
+	items []mergeItem
+	less  recordLess
+}
+
+func (h *mergeHeap) Len() int { return len(h.items) }
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.less(a.record, b.record) {
+		return true
+	}
+	if h.less(b.record, a.record) {
+		return false
+	}
+	return a.source < b.source
+}
+
+func (h *mergeHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+
+func (h *mergeHeap) Push(x interface{}) { h.items = append(h.items, x.(mergeItem)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// mergeSorted merges inputs that are each already sorted by less into one
+// sorted output. Unlike merge the result doesn't depend on scheduling: the
+// merge has to see the next record of every open input before it can send
+// anything, so a slow input holds the others back. Inputs may close at any
+// time; the output is closed once all of them have, or ctx is done.
+func mergeSorted(ctx context.Context, less recordLess, inputs ...<-chan []string) <-chan []string {
+	out := make(chan []string)
+
+	go func() {
+		defer close(out)
+
+		h := &mergeHeap{less: less}
+
+		// next reads the following record of input i onto the heap. It
+		// reports false if ctx ended while waiting.
+		next := func(i int) bool {
+			select {
+			case record, ok := <-inputs[i]:
+				if ok {
+					heap.Push(h, mergeItem{record: record, source: i})
+				}
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for i := range inputs {
+			if !next(i) {
+				return
+			}
+		}
+
+		for h.Len() > 0 {
+			item := heap.Pop(h).(mergeItem)
+
+			select {
+			case out <- item.record:
+			case <-ctx.Done():
+				return
+			}
+
+			if !next(item.source) {
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// sortedMergeExample sorts each CSV file on its first column and merges them
+// into one sorted stream.
+func sortedMergeExample() {
+	less := byColumn(0, false)
+
+	sorted := func(filename string) <-chan []string {
+		ch, err := read(filename)
+		if err != nil {
+			panic(err)
+		}
+
+		var records [][]string
+		for record := range ch {
+			records = append(records, record)
+		}
+		sort.SliceStable(records, func(i, j int) bool {
+			return less(records[i], records[j])
+		})
+
+		out := make(chan []string, len(records))
+		for _, record := range records {
+			out <- record
+		}
+		close(out)
+		return out
+	}
+
+	merged := mergeSorted(context.Background(), less, sorted("file1.csv"), sorted("file2.csv"))
+	for v := range merged {
+		fmt.Println(v)
+	}
+}
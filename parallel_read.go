@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+)
+
+type parallelReadOptions struct {
+	// Workers is the number of goroutines parsing, runtime.NumCPU() by
+	// default.
+	Workers int
+
+	// ChunkSize is roughly how many bytes each worker parses at a time, 1MB
+	// by default. Chunks end on a record boundary, so a record longer than
+	// ChunkSize makes its chunk bigger.
+	ChunkSize int
+
+	// Ordered sends records in file order. Otherwise each chunk's records
+	// are sent as soon as it is parsed, still in order within the chunk.
+	Ordered bool
+
+	// Comma is the field separator, ',' by default.
+	Comma rune
+}
+
+// csvChunk is a run of whole records from the file.
+type csvChunk struct {
+	data   []byte
+	line   int // line number of the first line of data
+	result chan csvChunkResult
+}
+
+type csvChunkResult struct {
+	records [][]string
+	err     error
+}
+
+// splitCSV returns the length of the longest prefix of data that ends on a
+// record boundary, or -1 if there is none. A newline is a boundary unless
+// it is inside a quoted field; since quotes inside a field are doubled, the
+// parity of the quotes seen so far says which it is.
+//
+// data must start on a record boundary. Scanning starts at from, with
+// inQuote saying whether data[:from] ends inside a quoted field, and the
+// returned inQuote says the same of all of data. As a boundary is never
+// inside quotes, that is also true of data after the returned end, so a
+// caller that keeps what is left and reads on can pass it back with
+// from set to where this scan stopped instead of scanning again.
+func splitCSV(data []byte, from int, inQuote bool) (int, bool) {
+	end := -1
+	for i := from; i < len(data); {
+		j := bytes.IndexAny(data[i:], "\"\n")
+		if j < 0 {
+			break
+		}
+		i += j
+		if data[i] == '"' {
+			inQuote = !inQuote
+		} else if !inQuote {
+			end = i + 1
+		}
+		i++
+	}
+	return end, inQuote
+}
+
+// parseChunk parses c, numbering lines in errors as in the whole file.
+func parseChunk(c csvChunk, comma rune) csvChunkResult {
+	cr := csv.NewReader(bytes.NewReader(c.data))
+	cr.FieldsPerRecord = -1
+	if comma != 0 {
+		cr.Comma = comma
+	}
+
+	var records [][]string
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			return csvChunkResult{records: records}
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if errors.As(err, &pe) {
+				pe.StartLine += c.line - 1
+				pe.Line += c.line - 1
+			}
+			return csvChunkResult{records: records, err: err}
+		}
+		records = append(records, record)
+	}
+}
+
+// readParallel is read for large files: one goroutine cuts the file into
+// chunks on record boundaries, and opts.Workers goroutines parse them. It
+// assumes quotes are used as RFC 4180 and csv.Reader expect, that is only
+// around whole fields and doubled inside them.
+//
+// Unlike read, records may have differing numbers of fields. Reading stops
+// at the first error in the file, which is sent on the error channel; in
+// ordered mode every record before it has been sent. A malformed quote can
+// make later chunks fail too, and their errors are not the one reported.
+func readParallel(ctx context.Context, filename string, opts parallelReadOptions) (<-chan []string, <-chan error) {
+	if opts.Workers <= 0 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 1 << 20
+	}
+
+	out := make(chan []string)
+	errc := make(chan error, 1)
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		errLine  int // where in the file firstErr is from
+	)
+	fail := func(line int, err error) {
+		mu.Lock()
+		if firstErr == nil || line < errLine {
+			firstErr, errLine = err, line
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	work := make(chan csvChunk, opts.Workers)
+	// pending holds the chunks in file order, for the ordered emitter.
+	pending := make(chan csvChunk, opts.Workers)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		defer close(pending)
+
+		f, err := os.Open(filename)
+		if err != nil {
+			fail(0, fmt.Errorf("opening file: %w", err))
+			return
+		}
+		defer f.Close()
+
+		var (
+			buf     []byte // read but not yet sent, from a record boundary
+			inQuote bool   // whether buf ends inside a quoted field
+			line    = 1
+		)
+		for eof := false; !eof; {
+			scanned := len(buf)
+			if cap(buf)-len(buf) < opts.ChunkSize {
+				// Doubling, so a record many chunks long isn't copied
+				// again for every chunk read.
+				grown := make([]byte, len(buf), 2*len(buf)+opts.ChunkSize)
+				copy(grown, buf)
+				buf = grown
+			}
+			n, err := io.ReadFull(f, buf[len(buf):len(buf)+opts.ChunkSize])
+			buf = buf[:len(buf)+n]
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				fail(line, fmt.Errorf("reading file: %w", err))
+				return
+			}
+
+			end := len(buf)
+			if !eof {
+				if end, inQuote = splitCSV(buf, scanned, inQuote); end < 0 {
+					// No complete record yet; read on.
+					continue
+				}
+			}
+			if end == 0 {
+				break
+			}
+
+			c := csvChunk{data: buf[:end:end], line: line}
+			if opts.Ordered {
+				c.result = make(chan csvChunkResult, 1)
+			}
+			line += bytes.Count(c.data, []byte{'\n'})
+
+			// What is left goes in a new buffer, as the workers own c.data.
+			rest := buf[end:]
+			buf = make([]byte, len(rest), len(rest)+opts.ChunkSize)
+			copy(buf, rest)
+
+			select {
+			case work <- c:
+			case <-ctx.Done():
+				return
+			}
+			if opts.Ordered {
+				select {
+				case pending <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	send := func(records [][]string) bool {
+		for _, record := range records {
+			select {
+			case out <- record:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range work {
+				r := parseChunk(c, opts.Comma)
+				if opts.Ordered {
+					c.result <- r
+					continue
+				}
+				// Chunks are taken in file order, so one that failed later
+				// in the file may have stopped the read while this one was
+				// being parsed. Its error is still reported, as it is the
+				// earlier one.
+				sent := send(r.records)
+				if r.err != nil {
+					fail(c.line, r.err)
+					return
+				}
+				if !sent {
+					return
+				}
+			}
+		}()
+	}
+
+	if opts.Ordered {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range pending {
+				var r csvChunkResult
+				select {
+				case r = <-c.result:
+				case <-ctx.Done():
+					return
+				}
+				if !send(r.records) {
+					return
+				}
+				if r.err != nil {
+					fail(c.line, r.err)
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		cancel()
+		close(out)
+
+		switch {
+		case firstErr != nil:
+			errc <- firstErr
+		case parent.Err() != nil:
+			errc <- parent.Err()
+		}
+		close(errc)
+	}()
+
+	return out, errc
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parallelReadTestData has quoted fields with commas, doubled quotes and
+// newlines, records of differing lengths and a record much longer than the
+// small chunk sizes, so chunk boundaries land inside all of them.
+func parallelReadTestData() string {
+	var b strings.Builder
+	for i := 0; i < 300; i++ {
+		switch i % 6 {
+		case 0:
+			fmt.Fprintf(&b, "%d,plain,row\n", i)
+		case 1:
+			fmt.Fprintf(&b, "%d,\"has, a comma\",x\n", i)
+		case 2:
+			fmt.Fprintf(&b, "%d,\"spans\nthree\nlines\",y\n", i)
+		case 3:
+			fmt.Fprintf(&b, "%d,\"says \"\"hi\"\"\nand more\"\n", i)
+		case 4:
+			fmt.Fprintf(&b, "%d,\"%s\",long\n", i, strings.Repeat("ab\n\"\"c", 40))
+		case 5:
+			fmt.Fprintf(&b, "%d\n", i)
+		}
+	}
+	return b.String()
+}
+
+func writeTestFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "data.csv")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readAllCSV is what csv.Reader makes of data, which readParallel should
+// match.
+func readAllCSV(data string) ([][]string, error) {
+	cr := csv.NewReader(strings.NewReader(data))
+	cr.FieldsPerRecord = -1
+	return cr.ReadAll()
+}
+
+func collectParallel(path string, opts parallelReadOptions) ([][]string, error) {
+	ch, errc := readParallel(context.Background(), path, opts)
+	var records [][]string
+	for r := range ch {
+		records = append(records, r)
+	}
+	return records, <-errc
+}
+
+func sortRecords(records [][]string) {
+	sort.Slice(records, func(i, j int) bool {
+		return strings.Join(records[i], "\x00") < strings.Join(records[j], "\x00")
+	})
+}
+
+func TestReadParallel(t *testing.T) {
+	data := parallelReadTestData()
+	want, err := readAllCSV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestFile(t, data)
+
+	for _, chunk := range []int{1, 7, 64, 0} {
+		for _, ordered := range []bool{true, false} {
+			t.Run(fmt.Sprintf("chunk=%d,ordered=%v", chunk, ordered), func(t *testing.T) {
+				got, err := collectParallel(path, parallelReadOptions{Workers: 4, ChunkSize: chunk, Ordered: ordered})
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := append([][]string(nil), want...)
+				if !ordered {
+					sortRecords(got)
+					sortRecords(want)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("got %d records, want %d as csv.Reader reads them", len(got), len(want))
+				}
+			})
+		}
+	}
+}
+
+func TestReadParallelErrorLine(t *testing.T) {
+	data := parallelReadTestData()
+	tests := map[string]string{
+		"bare quote":       data + "1,a\"b,c\n" + data,
+		"extraneous quote": data + "1,\"a\"b,c\n" + data,
+	}
+
+	for name, data := range tests {
+		_, wantErr := readAllCSV(data)
+		var want *csv.ParseError
+		if !errors.As(wantErr, &want) {
+			t.Fatalf("%s: csv.Reader gave %v, want a parse error", name, wantErr)
+		}
+		path := writeTestFile(t, data)
+
+		for _, chunk := range []int{1, 7, 64, 0} {
+			for _, ordered := range []bool{true, false} {
+				t.Run(fmt.Sprintf("%s,chunk=%d,ordered=%v", name, chunk, ordered), func(t *testing.T) {
+					_, err := collectParallel(path, parallelReadOptions{Workers: 4, ChunkSize: chunk, Ordered: ordered})
+					var got *csv.ParseError
+					if !errors.As(err, &got) {
+						t.Fatalf("got %v, want a parse error", err)
+					}
+					if got.StartLine != want.StartLine || got.Line != want.Line || !errors.Is(got.Err, want.Err) {
+						t.Fatalf("got %v, want %v", got, want)
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestSplitCSVResume(t *testing.T) {
+	data := []byte(parallelReadTestData())
+	wantEnd, wantQuote := splitCSV(data, 0, false)
+
+	// Scanning in pieces, passing the state on, ends up where one scan does.
+	end, inQuote := -1, false
+	for from := 0; from < len(data); from += 5 {
+		to := from + 5
+		if to > len(data) {
+			to = len(data)
+		}
+		if e, q := splitCSV(data[:to], from, inQuote); e >= 0 {
+			end = e
+			inQuote = q
+		} else {
+			inQuote = q
+		}
+	}
+	if end != wantEnd || inQuote != wantQuote {
+		t.Fatalf("resumed scan gave %d, %v, want %d, %v", end, inQuote, wantEnd, wantQuote)
+	}
+}
+
+const benchReadRecords = 200000
+
+// writeReadBenchFile writes a CSV file of benchReadRecords records, every
+// tenth with a quoted field holding a comma and a newline.
+func writeReadBenchFile(b *testing.B) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "big.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	for i := 0; i < benchReadRecords; i++ {
+		note := "plain"
+		if i%10 == 0 {
+			note = "has, a comma\nand a \"newline\""
+		}
+		w.Write([]string{strconv.Itoa(i), "name " + strconv.Itoa(i%977), note, strconv.Itoa(i * 7)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+func benchmarkRead(b *testing.B, open func(path string) (<-chan []string, <-chan error)) {
+	path := writeReadBenchFile(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch, errc := open(path)
+		n := 0
+		for range ch {
+			n++
+		}
+		if err := <-errc; err != nil {
+			b.Fatal(err)
+		}
+		if n != benchReadRecords {
+			b.Fatalf("read %d records, want %d", n, benchReadRecords)
+		}
+	}
+}
+
+func BenchmarkRead(b *testing.B) {
+	benchmarkRead(b, func(path string) (<-chan []string, <-chan error) {
+		ch, err := read(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		errc := make(chan error)
+		close(errc)
+		return ch, errc
+	})
+}
+
+func BenchmarkReadParallelOrdered(b *testing.B) {
+	benchmarkRead(b, func(path string) (<-chan []string, <-chan error) {
+		return readParallel(context.Background(), path, parallelReadOptions{Ordered: true})
+	})
+}
+
+func BenchmarkReadParallelUnordered(b *testing.B) {
+	benchmarkRead(b, func(path string) (<-chan []string, <-chan error) {
+		return readParallel(context.Background(), path, parallelReadOptions{})
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type partitionOptions struct {
+	Sink sinkOptions
+
+	// Dir is where the partitions are written, one subdirectory each.
+	Dir string
+
+	// Key gives the partition of a record, for example columnKey(2).
+	Key func([]string) string
+
+	// Buckets, if set, hashes keys into this many partitions instead of
+	// making one per distinct key.
+	Buckets int
+
+	// MaxOpen bounds the number of files open at once, 64 by default. When
+	// a record arrives for a partition that isn't open, the least recently
+	// written partition's file is finished to make room, and that partition
+	// continues in a new file if it gets more records.
+	MaxOpen int
+
+	// MaxRecords and MaxBytes start a new file for a partition once its
+	// current one has this many records or roughly this many bytes, before
+	// compression. Zero means no limit.
+	MaxRecords int64
+	MaxBytes   int64
+}
+
+// partitionFile is one file written by writePartitioned.
+type partitionFile struct {
+	Partition string `json:"partition"`
+	Path      string `json:"path"`
+	Records   int64  `json:"records"`
+}
+
+// partitionManifest lists the files of a partitioned output, in the order
+// they were finished.
+type partitionManifest struct {
+	Files []partitionFile `json:"files"`
+}
+
+// Partitions returns the names of the partitions, sorted.
+func (m *partitionManifest) Partitions() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, f := range m.Files {
+		if !seen[f.Partition] {
+			seen[f.Partition] = true
+			names = append(names, f.Partition)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Records returns the total number of records written.
+func (m *partitionManifest) Records() int64 {
+	var n int64
+	for _, f := range m.Files {
+		n += f.Records
+	}
+	return n
+}
+
+// openPartition is a partition with a file being written.
+type openPartition struct {
+	name string
+	w    *recordFileWriter
+	path string
+}
+
+// partitionWriter keeps the files of the most recently written partitions
+// open.
+type partitionWriter struct {
+	opts     partitionOptions
+	order    *list.List // most recently written first
+	open     map[string]*list.Element
+	parts    map[string]int // next part number of each partition
+	manifest partitionManifest
+}
+
+func (p *partitionWriter) partition(record []string) string {
+	key := p.opts.Key(record)
+	if p.opts.Buckets > 0 {
+		return fmt.Sprintf("bucket-%04d", hashKey(key)%uint64(p.opts.Buckets))
+	}
+	// Keys become directory names, so anything that isn't safe in a path
+	// segment is escaped. PathEscape leaves "." and ".." alone, and those
+	// would name Dir itself or its parent. The names used instead, and the
+	// one for the empty key, are ones PathEscape never returns, since it
+	// escapes "%" and only writes uppercase hex after one, so no key can
+	// share them.
+	if key == "" {
+		return "%empty"
+	}
+	switch name := url.PathEscape(key); name {
+	case ".":
+		return "%2E"
+	case "..":
+		return "%2E%2E"
+	default:
+		return name
+	}
+}
+
+func (p *partitionWriter) write(record []string) error {
+	name := p.partition(record)
+
+	el, ok := p.open[name]
+	if ok {
+		p.order.MoveToFront(el)
+	} else {
+		if p.order.Len() >= p.opts.MaxOpen {
+			if err := p.finish(p.order.Back()); err != nil {
+				return err
+			}
+		}
+
+		dir := filepath.Join(p.opts.Dir, name)
+		if rel, err := filepath.Rel(p.opts.Dir, dir); err != nil || rel != name {
+			return fmt.Errorf("partition %q is outside the output directory", name)
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("creating partition directory: %w", err)
+		}
+
+		path := filepath.Join(dir, fmt.Sprintf("part-%05d.%s", p.parts[name], p.opts.Sink.Format))
+		if p.opts.Sink.Gzip {
+			path += ".gz"
+		}
+		p.parts[name]++
+
+		w, err := createRecordFile(path, p.opts.Sink)
+		if err != nil {
+			return err
+		}
+		el = p.order.PushFront(&openPartition{name: name, w: w, path: path})
+		p.open[name] = el
+	}
+
+	op := el.Value.(*openPartition)
+	if err := op.w.Write(record); err != nil {
+		return err
+	}
+
+	if (p.opts.MaxRecords > 0 && op.w.Count() >= p.opts.MaxRecords) ||
+		(p.opts.MaxBytes > 0 && op.w.Size() >= p.opts.MaxBytes) {
+		return p.finish(el)
+	}
+	return nil
+}
+
+// finish commits the file of a partition and adds it to the manifest.
+func (p *partitionWriter) finish(el *list.Element) error {
+	op := el.Value.(*openPartition)
+	p.order.Remove(el)
+	delete(p.open, op.name)
+
+	if err := op.w.Commit(); err != nil {
+		return err
+	}
+	p.manifest.Files = append(p.manifest.Files, partitionFile{Partition: op.name, Path: op.path, Records: op.w.Count()})
+	return nil
+}
+
+func (p *partitionWriter) finishAll() error {
+	for p.order.Len() > 0 {
+		if err := p.finish(p.order.Back()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *partitionWriter) abortAll() {
+	for el := p.order.Front(); el != nil; el = el.Next() {
+		el.Value.(*openPartition).w.Abort()
+	}
+	p.order.Init()
+}
+
+// writePartitioned is a sink stage that splits in across files by
+// opts.Key, writing
+//
+//	dir/<partition>/part-00000.csv
+//	dir/<partition>/part-00001.csv
+//	...
+//
+// and a manifest.json in dir listing every file. Each file appears only
+// once it is complete, but if ctx ends or a write fails the files finished
+// so far stay and are listed in the returned manifest; the manifest file
+// itself is only written on success.
+func writePartitioned(ctx context.Context, in <-chan []string, opts partitionOptions) (*partitionManifest, error) {
+	if opts.MaxOpen <= 0 {
+		opts.MaxOpen = 64
+	}
+
+	p := &partitionWriter{
+		opts:  opts,
+		order: list.New(),
+		open:  make(map[string]*list.Element),
+		parts: make(map[string]int),
+	}
+
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		for range in {
+		}
+		return &p.manifest, fmt.Errorf("creating output directory: %w", err)
+	}
+
+	for {
+		select {
+		case record, ok := <-in:
+			if !ok {
+				if err := p.finishAll(); err != nil {
+					p.abortAll()
+					return &p.manifest, err
+				}
+				return &p.manifest, p.writeManifest()
+			}
+			if err := p.write(record); err != nil {
+				p.abortAll()
+				for range in {
+				}
+				return &p.manifest, err
+			}
+		case <-ctx.Done():
+			p.abortAll()
+			return &p.manifest, ctx.Err()
+		}
+	}
+}
+
+func (p *partitionWriter) writeManifest() error {
+	data, err := json.MarshalIndent(p.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+
+	f, err := createAtomic(filepath.Join(p.opts.Dir, "manifest.json"))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Abort()
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return f.Commit()
+}
+
+// partitionExample splits file1.csv and file2.csv by their first column,
+// two records to a file.
+func partitionExample() {
+	file1, err := read("file1.csv")
+	if err != nil {
+		panic(err)
+	}
+	file2, err := read("file2.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	m, err := writePartitioned(context.Background(), merge(file1, file2), partitionOptions{
+		Dir:        "partitioned",
+		Key:        columnKey(0),
+		MaxOpen:    4,
+		MaxRecords: 2,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, f := range m.Files {
+		fmt.Println(f.Partition, f.Path, f.Records)
+	}
+	fmt.Println(len(m.Partitions()), "partitions,", m.Records(), "records")
+}
@@ -35,6 +35,8 @@ func readCSV(filename string) (<-chan []string, error) {
 	return ch, nil
 }
 
+// sanitize passes on the records whose first field is at most three bytes,
+// without changing them.
 func sanitize(strC <-chan []string) <-chan []string {
 	ch := make(chan []string)
 
@@ -50,6 +52,8 @@ func sanitize(strC <-chan []string) <-chan []string {
 	return ch
 }
 
+// titleCase title-cases the first field of each record in place, so it must
+// own the records it receives; see record_pool.go.
 func titleCase(strC <-chan []string) <-chan []string {
 	ch := make(chan []string)
 
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Ownership of records
+//
+// A []string sent on a channel belongs to whoever receives it: the sender
+// must not touch it again, and the receiver may change it, pass it on or
+// drop it. titleCase relies on this when it rewrites the first field in
+// place. Stages that send one record to several receivers, like tee and
+// broadcast fan-outs, break the rule and need the receivers to treat the
+// record as read-only, or to copy it first.
+//
+// A *pooledRecord follows the same rule, with one more duty: the last owner
+// gives it back with Release once nothing refers to its Fields, and a stage
+// that drops a record releases it. After Release the record may be handed
+// out again at any moment, so keeping its Fields is a bug; use Clone for a
+// copy that outlives it.
+
+// pooledRecord is a record whose []string is reused through a recordPool.
+type pooledRecord struct {
+	Fields []string
+	pool   *recordPool
+}
+
+// Release gives r back to its pool. r must not be used afterwards.
+func (r *pooledRecord) Release() {
+	// Clear the fields so the pool doesn't keep their strings alive.
+	for i := range r.Fields {
+		r.Fields[i] = ""
+	}
+	r.Fields = r.Fields[:0]
+	r.pool.p.Put(r)
+}
+
+// Clone returns a copy of the fields that is safe to keep after Release.
+func (r *pooledRecord) Clone() []string {
+	return append([]string(nil), r.Fields...)
+}
+
+type recordPool struct {
+	p sync.Pool
+}
+
+func newRecordPool() *recordPool {
+	pool := &recordPool{}
+	pool.p.New = func() interface{} { return &pooledRecord{pool: pool} }
+	return pool
+}
+
+// copyOf returns a record from the pool holding the same fields as fields.
+// The strings themselves are shared, which is fine as strings are immutable.
+func (p *recordPool) copyOf(fields []string) *pooledRecord {
+	r := p.p.Get().(*pooledRecord)
+	r.Fields = append(r.Fields, fields...)
+	return r
+}
+
+// readPooled is readCSV with records from pool. The csv.Reader reuses its
+// own []string between rows, so the only allocation per row is the string
+// csv.Reader makes for the row's fields.
+func readPooled(ctx context.Context, filename string, pool *recordPool) (<-chan *pooledRecord, <-chan error) {
+	out := make(chan *pooledRecord)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+
+		f, err := os.Open(filename)
+		if err != nil {
+			errc <- fmt.Errorf("opening file: %w", err)
+			return
+		}
+		defer f.Close()
+
+		cr := csv.NewReader(f)
+		cr.FieldsPerRecord = -1
+		cr.ReuseRecord = true
+		for {
+			fields, err := cr.Read()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				errc <- fmt.Errorf("reading %s: %w", filename, err)
+				return
+			}
+
+			r := pool.copyOf(fields)
+			select {
+			case out <- r:
+			case <-ctx.Done():
+				r.Release()
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return out, errc
+}
+
+// sanitizePooled is sanitize for pooled records; it releases the records it
+// drops.
+func sanitizePooled(in <-chan *pooledRecord) <-chan *pooledRecord {
+	out := make(chan *pooledRecord)
+	go func() {
+		defer close(out)
+		for r := range in {
+			if len(r.Fields) == 0 || len(r.Fields[0]) > 3 {
+				r.Release()
+				continue
+			}
+			out <- r
+		}
+	}()
+	return out
+}
+
+// titleCasePooled is titleCase for pooled records. Like titleCase it owns
+// the records it receives and changes them in place.
+func titleCasePooled(in <-chan *pooledRecord) <-chan *pooledRecord {
+	out := make(chan *pooledRecord)
+	go func() {
+		defer close(out)
+		for r := range in {
+			if len(r.Fields) > 0 {
+				r.Fields[0] = strings.Title(r.Fields[0])
+			}
+			out <- r
+		}
+	}()
+	return out
+}
+
+// unpool copies pooled records into plain ones and releases them, so
+// pooled stages can feed every other stage.
+func unpool(in <-chan *pooledRecord) <-chan []string {
+	out := make(chan []string)
+	go func() {
+		defer close(out)
+		for r := range in {
+			record := r.Clone()
+			r.Release()
+			out <- record
+		}
+	}()
+	return out
+}
+
+// recordPoolExample runs pipeline.csv through the pooled versions of
+// sanitize and titleCase.
+func recordPoolExample() {
+	pool := newRecordPool()
+
+	records, errc := readPooled(context.Background(), "pipeline.csv", pool)
+	for r := range titleCasePooled(sanitizePooled(records)) {
+		fmt.Println(r.Fields)
+		r.Release()
+	}
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+}
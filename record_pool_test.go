@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+const benchPoolRows = 100000
+
+// writePoolBenchFile writes benchPoolRows rows whose first fields are short
+// enough that sanitize keeps them.
+func writePoolBenchFile(b *testing.B) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "rows.csv")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	for i := 0; i < benchPoolRows; i++ {
+		w.Write([]string{"ab" + strconv.Itoa(i%20), "second", strconv.Itoa(i)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// benchmarkPerRow runs pass, one read of the whole file, b.N times and
+// reports its allocations per row as well as per pass. They are counted
+// from the memory statistics, as the pipeline's own goroutines do most of
+// the allocating.
+func benchmarkPerRow(b *testing.B, pass func()) {
+	b.ReportAllocs()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pass()
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N)/benchPoolRows, "allocs/row")
+}
+
+func BenchmarkRecordsUnpooled(b *testing.B) {
+	path := writePoolBenchFile(b)
+	benchmarkPerRow(b, func() {
+		ch, err := readCSV(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for range titleCase(sanitize(ch)) {
+		}
+	})
+}
+
+func BenchmarkRecordsPooled(b *testing.B) {
+	path := writePoolBenchFile(b)
+	pool := newRecordPool()
+	benchmarkPerRow(b, func() {
+		records, errc := readPooled(context.Background(), path, pool)
+		for r := range titleCasePooled(sanitizePooled(records)) {
+			r.Release()
+		}
+		if err := <-errc; err != nil {
+			b.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrQueueClosed = errors.New("queue closed")
+
+// cacheLinePad keeps the producer and consumer indexes on separate cache
+// lines, so the two sides don't slow each other down by writing to the
+// same line.
+type cacheLinePad [56]byte
+
+// ringQueue is what the blocking operations and the channel adapter need
+// from spscQueue and mpmcQueue.
+type ringQueue[T any] interface {
+	TryPush(v T) bool
+	TryPop() (T, bool)
+	Close()
+	isClosed() bool
+}
+
+// ringLen is the number of items between *head and *tail. head is read on
+// both sides of tail and the pair only used if it didn't move, so the two
+// were true at the same moment; otherwise a pop between the loads could put
+// head past the tail that was read.
+func ringLen(head, tail *uint64, capacity uint64) int {
+	for {
+		h := atomic.LoadUint64(head)
+		t := atomic.LoadUint64(tail)
+		if atomic.LoadUint64(head) != h {
+			continue
+		}
+		n := int64(t - h)
+		switch {
+		case n < 0:
+			return 0
+		case uint64(n) > capacity:
+			return int(capacity)
+		}
+		return int(n)
+	}
+}
+
+// ringSize rounds capacity up to a power of two, so indexes can be masked
+// instead of divided.
+func ringSize(capacity int) uint64 {
+	n := uint64(1)
+	for n < uint64(capacity) {
+		n <<= 1
+	}
+	return n
+}
+
+// spscQueue is a bounded queue for exactly one producer goroutine and one
+// consumer goroutine. Neither side ever locks: each owns one index and
+// only reads the other's.
+type spscQueue[T any] struct {
+	head   uint64 // next slot to pop, written by the consumer
+	_      cacheLinePad
+	tail   uint64 // next slot to push, written by the producer
+	_      cacheLinePad
+	closed int32
+	mask   uint64
+	buf    []T
+}
+
+func newSPSCQueue[T any](capacity int) *spscQueue[T] {
+	n := ringSize(capacity)
+	return &spscQueue[T]{mask: n - 1, buf: make([]T, n)}
+}
+
+// TryPush adds v unless the queue is full.
+func (q *spscQueue[T]) TryPush(v T) bool {
+	tail := atomic.LoadUint64(&q.tail)
+	if tail-atomic.LoadUint64(&q.head) > q.mask {
+		return false
+	}
+	q.buf[tail&q.mask] = v
+	atomic.StoreUint64(&q.tail, tail+1)
+	return true
+}
+
+// TryPop removes the oldest item unless the queue is empty.
+func (q *spscQueue[T]) TryPop() (T, bool) {
+	var zero T
+	head := atomic.LoadUint64(&q.head)
+	if head == atomic.LoadUint64(&q.tail) {
+		return zero, false
+	}
+	v := q.buf[head&q.mask]
+	q.buf[head&q.mask] = zero
+	atomic.StoreUint64(&q.head, head+1)
+	return v, true
+}
+
+// Len is the number of items queued at some moment during the call.
+func (q *spscQueue[T]) Len() int {
+	return ringLen(&q.head, &q.tail, q.mask+1)
+}
+
+// Close stops further pushes. Items already queued can still be popped.
+func (q *spscQueue[T]) Close()         { atomic.StoreInt32(&q.closed, 1) }
+func (q *spscQueue[T]) isClosed() bool { return atomic.LoadInt32(&q.closed) == 1 }
+
+func (q *spscQueue[T]) Push(v T) error { return pushWait[T](context.Background(), q, v) }
+func (q *spscQueue[T]) Pop() (T, bool) {
+	v, err := popWait[T](context.Background(), q)
+	return v, err == nil
+}
+func (q *spscQueue[T]) PushCtx(ctx context.Context, v T) error { return pushWait[T](ctx, q, v) }
+func (q *spscQueue[T]) PopCtx(ctx context.Context) (T, error)  { return popWait[T](ctx, q) }
+
+// mpmcQueue is a bounded queue for any number of producers and consumers,
+// after Dmitry Vyukov's design. Each slot carries a sequence number saying
+// whose turn it is: a producer may fill slot pos when its sequence is pos,
+// a consumer may empty it when it is pos+1. Claiming a slot is a single
+// compare-and-swap on the shared index.
+type mpmcQueue[T any] struct {
+	head   uint64
+	_      cacheLinePad
+	tail   uint64
+	_      cacheLinePad
+	closed int32
+	mask   uint64
+	cells  []mpmcCell[T]
+}
+
+type mpmcCell[T any] struct {
+	seq uint64
+	val T
+}
+
+func newMPMCQueue[T any](capacity int) *mpmcQueue[T] {
+	n := ringSize(capacity)
+	q := &mpmcQueue[T]{mask: n - 1, cells: make([]mpmcCell[T], n)}
+	for i := range q.cells {
+		q.cells[i].seq = uint64(i)
+	}
+	return q
+}
+
+// TryPush adds v unless the queue is full.
+func (q *mpmcQueue[T]) TryPush(v T) bool {
+	pos := atomic.LoadUint64(&q.tail)
+	for {
+		c := &q.cells[pos&q.mask]
+		switch dif := int64(atomic.LoadUint64(&c.seq) - pos); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint64(&q.tail, pos, pos+1) {
+				c.val = v
+				atomic.StoreUint64(&c.seq, pos+1)
+				return true
+			}
+		case dif < 0:
+			// The slot still holds the item from a lap ago: full.
+			return false
+		}
+		pos = atomic.LoadUint64(&q.tail)
+	}
+}
+
+// TryPop removes the oldest item unless the queue is empty.
+func (q *mpmcQueue[T]) TryPop() (T, bool) {
+	var zero T
+	pos := atomic.LoadUint64(&q.head)
+	for {
+		c := &q.cells[pos&q.mask]
+		switch dif := int64(atomic.LoadUint64(&c.seq) - (pos + 1)); {
+		case dif == 0:
+			if atomic.CompareAndSwapUint64(&q.head, pos, pos+1) {
+				v := c.val
+				c.val = zero
+				atomic.StoreUint64(&c.seq, pos+q.mask+1)
+				return v, true
+			}
+		case dif < 0:
+			// Nothing has been pushed to this slot yet: empty.
+			return zero, false
+		}
+		pos = atomic.LoadUint64(&q.head)
+	}
+}
+
+// Len is approximate while other goroutines are pushing or popping: a
+// slot is counted from when it is claimed, before its item is written.
+func (q *mpmcQueue[T]) Len() int {
+	return ringLen(&q.head, &q.tail, q.mask+1)
+}
+
+// Close stops further pushes. Items already queued can still be popped. A
+// push racing with Close may still get in after the consumers have seen the
+// queue closed and empty, so close only once the producers have finished.
+func (q *mpmcQueue[T]) Close()         { atomic.StoreInt32(&q.closed, 1) }
+func (q *mpmcQueue[T]) isClosed() bool { return atomic.LoadInt32(&q.closed) == 1 }
+
+func (q *mpmcQueue[T]) Push(v T) error { return pushWait[T](context.Background(), q, v) }
+func (q *mpmcQueue[T]) Pop() (T, bool) {
+	v, err := popWait[T](context.Background(), q)
+	return v, err == nil
+}
+func (q *mpmcQueue[T]) PushCtx(ctx context.Context, v T) error { return pushWait[T](ctx, q, v) }
+func (q *mpmcQueue[T]) PopCtx(ctx context.Context) (T, error)  { return popWait[T](ctx, q) }
+
+// backoff is how the blocking operations wait without a lock to sleep on:
+// spin briefly, then yield, then sleep for longer and longer, up to about a
+// millisecond. Nothing wakes a waiter early, so once a queue has been full
+// or empty for a while, Push and Pop can take up to that long to notice it
+// has room or an item. Where that latency matters, keep the queue from
+// running dry, or use a channel.
+type backoff struct {
+	n int
+}
+
+func (b *backoff) wait(ctx context.Context) error {
+	b.n++
+	switch {
+	case b.n <= 16:
+	case b.n <= 64:
+		runtime.Gosched()
+	default:
+		shift := b.n - 64
+		if shift > 10 {
+			shift = 10
+		}
+		d := time.Microsecond << uint(shift)
+		if ctx.Done() == nil {
+			time.Sleep(d)
+			break
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+	}
+	return ctx.Err()
+}
+
+// pushWait pushes v, waiting while q is full. It fails once q is closed or
+// ctx ends.
+func pushWait[T any](ctx context.Context, q ringQueue[T], v T) error {
+	var b backoff
+	for {
+		if q.isClosed() {
+			return ErrQueueClosed
+		}
+		if q.TryPush(v) {
+			return nil
+		}
+		if err := b.wait(ctx); err != nil {
+			return err
+		}
+	}
+}
+
+// popWait pops an item, waiting while q is empty. It fails once q is closed
+// and empty, or ctx ends.
+func popWait[T any](ctx context.Context, q ringQueue[T]) (T, error) {
+	var b backoff
+	for {
+		if v, ok := q.TryPop(); ok {
+			return v, nil
+		}
+		if q.isClosed() {
+			// Catch anything pushed just before the close.
+			if v, ok := q.TryPop(); ok {
+				return v, nil
+			}
+			var zero T
+			return zero, ErrQueueClosed
+		}
+		if err := b.wait(ctx); err != nil {
+			var zero T
+			return zero, err
+		}
+	}
+}
+
+// queueChannel puts a ring queue behind the SimpleInChannel and
+// SimpleOutChannel interfaces, so it can be used with tee3. One goroutine
+// moves values from In into the queue and another from the queue to Out;
+// as there is only one of each, an spscQueue is safe here. The channels
+// add back some of the cost the queue saves, so hot paths should use the
+// queue's own methods.
+type queueChannel struct {
+	in  chan interface{}
+	out chan interface{}
+}
+
+func newQueueChannel(q ringQueue[interface{}]) *queueChannel {
+	c := &queueChannel{in: make(chan interface{}), out: make(chan interface{})}
+
+	go func() {
+		defer q.Close()
+		for v := range c.in {
+			pushWait(context.Background(), q, v)
+		}
+	}()
+
+	go func() {
+		defer close(c.out)
+		for {
+			v, err := popWait(context.Background(), q)
+			if err != nil {
+				return
+			}
+			c.out <- v
+		}
+	}()
+
+	return c
+}
+
+func (c *queueChannel) In() chan<- interface{}  { return c.in }
+func (c *queueChannel) Out() <-chan interface{} { return c.out }
+func (c *queueChannel) Close()                  { close(c.in) }
+
+// ringQueueExample tees the numbers 0 to 9 into two queue-backed channels.
+func ringQueueExample() {
+	input := newQueueChannel(newSPSCQueue[interface{}](8))
+	outputs := []SimpleInChannel{
+		newQueueChannel(newSPSCQueue[interface{}](8)),
+		newQueueChannel(newMPMCQueue[interface{}](8)),
+	}
+
+	go func() {
+		for i := 0; i < 10; i++ {
+			input.In() <- i
+		}
+		input.Close()
+	}()
+	go tee3(input, outputs, true)
+
+	var wg sync.WaitGroup
+	for i, o := range outputs {
+		wg.Add(1)
+		go func(i int, o SimpleOutChannel) {
+			defer wg.Done()
+			for v := range o.Out() {
+				fmt.Println("output", i, v)
+			}
+		}(i, o.(SimpleOutChannel))
+	}
+	wg.Wait()
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingQueue is the blocking half of spscQueue and mpmcQueue.
+type blockingQueue interface {
+	Push(v int) error
+	Pop() (int, bool)
+	Len() int
+	Close()
+}
+
+func TestSPSCQueueOrder(t *testing.T) {
+	const n = 100000
+	q := newSPSCQueue[int](4)
+
+	go func() {
+		for i := 0; i < n; i++ {
+			if err := q.Push(i); err != nil {
+				t.Errorf("push %d: %v", i, err)
+				return
+			}
+		}
+		q.Close()
+	}()
+
+	want := 0
+	for {
+		if l := q.Len(); l < 0 || l > 4 {
+			t.Fatalf("Len() = %d, want 0 to 4", l)
+		}
+		v, ok := q.Pop()
+		if !ok {
+			break
+		}
+		if v != want {
+			t.Fatalf("popped %d, want %d", v, want)
+		}
+		want++
+	}
+	if want != n {
+		t.Fatalf("popped %d items, want %d", want, n)
+	}
+}
+
+func TestMPMCQueueExactlyOnce(t *testing.T) {
+	const (
+		n         = 100000
+		producers = 4
+		consumers = 4
+	)
+	q := newMPMCQueue[int](8)
+
+	var produced sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		produced.Add(1)
+		go func(p int) {
+			defer produced.Done()
+			for i := p; i < n; i += producers {
+				if err := q.Push(i); err != nil {
+					t.Errorf("push %d: %v", i, err)
+					return
+				}
+			}
+		}(p)
+	}
+	go func() {
+		produced.Wait()
+		q.Close()
+	}()
+
+	seen := make([]int32, n)
+	var consumed sync.WaitGroup
+	for c := 0; c < consumers; c++ {
+		consumed.Add(1)
+		go func() {
+			defer consumed.Done()
+			for {
+				v, ok := q.Pop()
+				if !ok {
+					return
+				}
+				atomic.AddInt32(&seen[v], 1)
+			}
+		}()
+	}
+	consumed.Wait()
+
+	for v, count := range seen {
+		if count != 1 {
+			t.Fatalf("item %d popped %d times, want once", v, count)
+		}
+	}
+}
+
+func TestRingQueueWraparound(t *testing.T) {
+	queues := map[string]ringQueue[int]{
+		"spsc": newSPSCQueue[int](4),
+		"mpmc": newMPMCQueue[int](4),
+	}
+	for name, q := range queues {
+		t.Run(name, func(t *testing.T) {
+			next, want := 0, 0
+			// Enough laps that both indexes wrap the buffer many times.
+			for lap := 0; lap < 10; lap++ {
+				if _, ok := q.TryPop(); ok {
+					t.Fatalf("lap %d: popped from an empty queue", lap)
+				}
+				for i := 0; i < 4; i++ {
+					if !q.TryPush(next) {
+						t.Fatalf("lap %d: push %d refused with %d queued", lap, next, i)
+					}
+					next++
+				}
+				if q.TryPush(next) {
+					t.Fatalf("lap %d: pushed to a full queue", lap)
+				}
+				if l := q.(blockingQueue).Len(); l != 4 {
+					t.Fatalf("lap %d: Len() = %d, want 4", lap, l)
+				}
+
+				// Leave one behind so the next lap starts part way round.
+				for i := 0; i < 3; i++ {
+					v, ok := q.TryPop()
+					if !ok || v != want {
+						t.Fatalf("lap %d: popped %d, %v, want %d", lap, v, ok, want)
+					}
+					want++
+				}
+				if !q.TryPush(next) {
+					t.Fatalf("lap %d: push refused after popping", lap)
+				}
+				next++
+				for i := 0; i < 2; i++ {
+					v, ok := q.TryPop()
+					if !ok || v != want {
+						t.Fatalf("lap %d: popped %d, %v, want %d", lap, v, ok, want)
+					}
+					want++
+				}
+			}
+		})
+	}
+}
+
+func TestRingQueueClose(t *testing.T) {
+	for name, q := range map[string]blockingQueue{
+		"spsc": newSPSCQueue[int](4),
+		"mpmc": newMPMCQueue[int](4),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if err := q.Push(1); err != nil {
+				t.Fatal(err)
+			}
+			q.Close()
+
+			if err := q.Push(2); !errors.Is(err, ErrQueueClosed) {
+				t.Fatalf("push after close: got %v, want ErrQueueClosed", err)
+			}
+			if v, ok := q.Pop(); !ok || v != 1 {
+				t.Fatalf("got %d, %v, want the item queued before close", v, ok)
+			}
+			if _, ok := q.Pop(); ok {
+				t.Fatal("popped from a closed, empty queue")
+			}
+		})
+	}
+}
+
+func TestRingQueueCancel(t *testing.T) {
+	q := newMPMCQueue[int](2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.PopCtx(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("pop from empty queue: got %v, want DeadlineExceeded", err)
+	}
+
+	q.TryPush(1)
+	q.TryPush(2)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := q.PushCtx(ctx, 3); !errors.Is(err, context.Canceled) {
+		t.Fatalf("push to full queue: got %v, want Canceled", err)
+	}
+	if l := q.Len(); l != 2 {
+		t.Fatalf("Len() = %d after a cancelled push, want 2", l)
+	}
+}
+
+func TestQueueChannel(t *testing.T) {
+	for name, q := range map[string]ringQueue[interface{}]{
+		"spsc": newSPSCQueue[interface{}](2),
+		"mpmc": newMPMCQueue[interface{}](2),
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := newQueueChannel(q)
+			go func() {
+				for i := 0; i < 100; i++ {
+					c.In() <- i
+				}
+				c.Close()
+			}()
+
+			want := 0
+			for v := range c.Out() {
+				if v != want {
+					t.Fatalf("got %v, want %d", v, want)
+				}
+				want++
+			}
+			if want != 100 {
+				t.Fatalf("got %d values, want 100", want)
+			}
+			if !q.isClosed() {
+				t.Fatal("closing the channel didn't close the queue")
+			}
+		})
+	}
+}
+
+// benchQueue is a queue under benchmark; done is called once every push
+// has returned.
+type benchQueue struct {
+	push func(int)
+	pop  func() bool
+	done func()
+}
+
+const benchQueueCapacity = 1024
+
+func newBenchChan() benchQueue {
+	ch := make(chan int, benchQueueCapacity)
+	return benchQueue{
+		push: func(v int) { ch <- v },
+		pop:  func() bool { _, ok := <-ch; return ok },
+		done: func() { close(ch) },
+	}
+}
+
+func newBenchQueue(q blockingQueue) benchQueue {
+	return benchQueue{
+		push: func(v int) { q.Push(v) },
+		pop:  func() bool { _, ok := q.Pop(); return ok },
+		done: q.Close,
+	}
+}
+
+// benchmarkQueue passes b.N ints through q from producers to consumers.
+func benchmarkQueue(b *testing.B, q benchQueue, producers, consumers int) {
+	b.ReportAllocs()
+
+	var consumed sync.WaitGroup
+	var popped int64
+	for i := 0; i < consumers; i++ {
+		consumed.Add(1)
+		go func() {
+			defer consumed.Done()
+			for q.pop() {
+				atomic.AddInt64(&popped, 1)
+			}
+		}()
+	}
+
+	var produced sync.WaitGroup
+	for i := 0; i < producers; i++ {
+		produced.Add(1)
+		go func(i int) {
+			defer produced.Done()
+			for n := i; n < b.N; n += producers {
+				q.push(n)
+			}
+		}(i)
+	}
+
+	produced.Wait()
+	q.done()
+	consumed.Wait()
+	if popped != int64(b.N) {
+		b.Fatalf("popped %d, want %d", popped, b.N)
+	}
+}
+
+func BenchmarkChan1x1(b *testing.B) {
+	benchmarkQueue(b, newBenchChan(), 1, 1)
+}
+
+func BenchmarkSPSCQueue1x1(b *testing.B) {
+	benchmarkQueue(b, newBenchQueue(newSPSCQueue[int](benchQueueCapacity)), 1, 1)
+}
+
+func BenchmarkMPMCQueue1x1(b *testing.B) {
+	benchmarkQueue(b, newBenchQueue(newMPMCQueue[int](benchQueueCapacity)), 1, 1)
+}
+
+func BenchmarkChan4x4(b *testing.B) {
+	benchmarkQueue(b, newBenchChan(), 4, 4)
+}
+
+func BenchmarkMPMCQueue4x4(b *testing.B) {
+	benchmarkQueue(b, newBenchQueue(newMPMCQueue[int](benchQueueCapacity)), 4, 4)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+type columnType string
+
+const (
+	typeString columnType = "string"
+	typeInt    columnType = "int"
+	typeFloat  columnType = "float"
+	typeBool   columnType = "bool"
+	typeTime   columnType = "time"
+)
+
+// inferLayouts are the time formats inferSchema recognises.
+var inferLayouts = []string{time.RFC3339, "2006-01-02", "2006-01-02 15:04:05"}
+
+type columnSchema struct {
+	Name string     `json:"name"`
+	Type columnType `json:"type"`
+
+	// Nullable allows the column to be empty. A non-nullable column is
+	// required.
+	Nullable bool `json:"nullable"`
+
+	// Min and Max bound int and float columns.
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+
+	// Pattern is a regular expression the whole value must match.
+	Pattern string `json:"pattern,omitempty"`
+
+	// Layout is the format of time columns, RFC 3339 if empty.
+	Layout string `json:"layout,omitempty"`
+
+	re *regexp.Regexp
+}
+
+type recordSchema struct {
+	Columns []columnSchema `json:"columns"`
+
+	// AllowExtra accepts records with more fields than there are columns.
+	AllowExtra bool `json:"allowExtra"`
+}
+
+// compile prepares the patterns; it must be called before validate.
+func (s *recordSchema) compile() error {
+	for i := range s.Columns {
+		c := &s.Columns[i]
+		switch c.Type {
+		case typeString, typeInt, typeFloat, typeBool, typeTime:
+		case "":
+			c.Type = typeString
+		default:
+			return fmt.Errorf("column %q: unknown type %q", c.Name, c.Type)
+		}
+
+		if c.Pattern != "" {
+			re, err := regexp.Compile("^(?:" + c.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("column %q: %w", c.Name, err)
+			}
+			c.re = re
+		}
+	}
+	return nil
+}
+
+// loadSchema reads a schema declared as JSON, for example
+//
+//	{"columns": [{"name": "age", "type": "int", "min": 0, "max": 150}]}
+func loadSchema(filename string) (*recordSchema, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema: %w", err)
+	}
+
+	var s recordSchema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("parsing schema: %w", err)
+	}
+	if err := s.compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// validate returns every reason record breaks the schema, nil if it doesn't.
+func (s *recordSchema) validate(record []string) []string {
+	var reasons []string
+
+	if len(record) < len(s.Columns) || (len(record) > len(s.Columns) && !s.AllowExtra) {
+		reasons = append(reasons, fmt.Sprintf("has %d fields, want %d", len(record), len(s.Columns)))
+	}
+
+	for i, c := range s.Columns {
+		if i >= len(record) {
+			break
+		}
+		v := record[i]
+
+		if v == "" {
+			if !c.Nullable {
+				reasons = append(reasons, fmt.Sprintf("%s: required", c.Name))
+			}
+			continue
+		}
+
+		var number float64
+		var err error
+		switch c.Type {
+		case typeInt:
+			var n int64
+			n, err = strconv.ParseInt(v, 10, 64)
+			number = float64(n)
+		case typeFloat:
+			number, err = strconv.ParseFloat(v, 64)
+		case typeBool:
+			_, err = strconv.ParseBool(v)
+		case typeTime:
+			layout := c.Layout
+			if layout == "" {
+				layout = time.RFC3339
+			}
+			_, err = time.Parse(layout, v)
+		}
+		if err != nil {
+			reasons = append(reasons, fmt.Sprintf("%s: %q is not a %s", c.Name, v, c.Type))
+			continue
+		}
+
+		if c.Type == typeInt || c.Type == typeFloat {
+			if c.Min != nil && number < *c.Min {
+				reasons = append(reasons, fmt.Sprintf("%s: %s is below %g", c.Name, v, *c.Min))
+			}
+			if c.Max != nil && number > *c.Max {
+				reasons = append(reasons, fmt.Sprintf("%s: %s is above %g", c.Name, v, *c.Max))
+			}
+		}
+
+		if c.re != nil && !c.re.MatchString(v) {
+			reasons = append(reasons, fmt.Sprintf("%s: %q does not match %s", c.Name, v, c.Pattern))
+		}
+	}
+
+	return reasons
+}
+
+// inferSchema reads up to sampleSize records from in and guesses a type for
+// each column: the narrowest of bool, int, float and time that every
+// non-empty sampled value parses as, else string. A column is nullable if any
+// sampled value was empty. names labels the columns and may be nil.
+//
+// The sampled records are not lost: the returned channel replays them and
+// then carries on with the rest of in.
+func inferSchema(ctx context.Context, in <-chan []string, sampleSize int, names []string) (*recordSchema, <-chan []string) {
+	type candidate struct {
+		isBool, isInt, isFloat bool
+		layout                 string
+		values                 int
+		seen, empty            bool
+	}
+
+	var (
+		sample     [][]string
+		candidates []*candidate
+	)
+
+	for len(sample) < sampleSize {
+		var record []string
+		var ok bool
+		select {
+		case record, ok = <-in:
+		case <-ctx.Done():
+		}
+		if !ok {
+			break
+		}
+		sample = append(sample, record)
+
+		for len(candidates) < len(record) {
+			candidates = append(candidates, &candidate{isBool: true, isInt: true, isFloat: true, layout: "?"})
+		}
+
+		for i, v := range record {
+			c := candidates[i]
+			c.values++
+			if v == "" {
+				c.empty = true
+				continue
+			}
+			c.seen = true
+			if _, err := strconv.ParseBool(v); err != nil {
+				c.isBool = false
+			}
+			if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+				c.isInt = false
+			}
+			if _, err := strconv.ParseFloat(v, 64); err != nil {
+				c.isFloat = false
+			}
+			if c.layout != "" {
+				c.layout = matchLayout(v, c.layout)
+			}
+		}
+	}
+
+	s := &recordSchema{}
+	for i, c := range candidates {
+		// Short records count as empty values for their missing columns.
+		col := columnSchema{Name: "col " + strconv.Itoa(i), Type: typeString, Nullable: c.empty || c.values < len(sample)}
+		if i < len(names) {
+			col.Name = names[i]
+		}
+
+		switch {
+		case !c.seen:
+		case c.isBool && !c.isInt:
+			// "1" and "0" parse as bools, but a column of them is numeric.
+			col.Type = typeBool
+		case c.isInt:
+			col.Type = typeInt
+		case c.isFloat:
+			col.Type = typeFloat
+		case c.layout != "" && c.layout != "?":
+			col.Type = typeTime
+			col.Layout = c.layout
+		}
+		s.Columns = append(s.Columns, col)
+	}
+	s.compile()
+
+	out := make(chan []string)
+	go func() {
+		defer close(out)
+		for _, record := range sample {
+			select {
+			case out <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+		for record := range in {
+			select {
+			case out <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return s, out
+}
+
+// matchLayout returns the layout v parses with: current if it is still
+// undecided ("?") or v fits it, otherwise "" for not a time.
+func matchLayout(v, current string) string {
+	if current != "?" {
+		if _, err := time.Parse(current, v); err == nil {
+			return current
+		}
+		return ""
+	}
+	for _, layout := range inferLayouts {
+		if _, err := time.Parse(layout, v); err == nil {
+			return layout
+		}
+	}
+	return ""
+}
+
+// invalidRecord is a record that failed validation. Index counts records
+// from 1 in the order they reached the validator.
+type invalidRecord struct {
+	Record  []string
+	Index   int
+	Reasons []string
+}
+
+// validateRecords checks every record of in against schema. Records that
+// pass are sent on the first channel, the rest with their reasons on the
+// second, so bad rows are set aside instead of stopping the pipeline. Like
+// tee, both outputs have to be read.
+func validateRecords(ctx context.Context, in <-chan []string, schema *recordSchema) (<-chan []string, <-chan invalidRecord) {
+	valid := make(chan []string)
+	invalid := make(chan invalidRecord)
+
+	go func() {
+		defer close(valid)
+		defer close(invalid)
+
+		n := 0
+		for record := range in {
+			n++
+			if reasons := schema.validate(record); reasons != nil {
+				select {
+				case invalid <- invalidRecord{Record: record, Index: n, Reasons: reasons}:
+				case <-ctx.Done():
+					return
+				}
+				continue
+			}
+
+			select {
+			case valid <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return valid, invalid
+}
+
+// schemaExample infers a schema from people.csv, then validates the file
+// against people.schema.json, which is stricter about ages and names.
+func schemaExample() {
+	ctx := context.Background()
+
+	header, ch, errc, err := readWithHeader(ctx, "people.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	inferred, ch := inferSchema(ctx, ch, 100, header.Names())
+	out, _ := json.MarshalIndent(inferred, "", "  ")
+	fmt.Println(string(out))
+
+	declared, err := loadSchema("people.schema.json")
+	if err != nil {
+		panic(err)
+	}
+
+	valid, invalid := validateRecords(ctx, ch, declared)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for bad := range invalid {
+			fmt.Println("quarantined", bad.Index, bad.Record, bad.Reasons)
+		}
+	}()
+
+	for v := range valid {
+		fmt.Println("valid", v)
+	}
+	<-done
+
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+}
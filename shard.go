@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ringReplicas is the number of points each shard gets on the hash ring. More
+// points spread keys more evenly between shards.
+const ringReplicas = 64
+
+// hashRing maps keys to shards by consistent hashing, so that changing the
+// number of shards from n to m only moves about |n-m|/max(n,m) of the keys.
+type hashRing struct {
+	points []uint64
+	shards []int
+}
+
+func newHashRing(n int) *hashRing {
+	r := &hashRing{}
+	type point struct {
+		hash  uint64
+		shard int
+	}
+
+	points := make([]point, 0, n*ringReplicas)
+	for shard := 0; shard < n; shard++ {
+		for replica := 0; replica < ringReplicas; replica++ {
+			points = append(points, point{hashKey(strconv.Itoa(shard) + "#" + strconv.Itoa(replica)), shard})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].hash < points[j].hash })
+
+	r.points = make([]uint64, len(points))
+	r.shards = make([]int, len(points))
+	for i, p := range points {
+		r.points[i] = p.hash
+		r.shards[i] = p.shard
+	}
+	return r
+}
+
+func (r *hashRing) shard(key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.shards[i]
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// fnv alone clusters similar short keys; mix the bits before they are
+	// placed on the ring.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return x
+}
+
+// columnKey returns a key function for the given CSV columns, for use with
+// ShardBy and the other keyed stages.
+func columnKey(cols ...int) func([]string) string {
+	return func(record []string) string {
+		if len(cols) == 1 {
+			return record[cols[0]]
+		}
+		parts := make([]string, len(cols))
+		for i, c := range cols {
+			parts[i] = record[c]
+		}
+		return strings.Join(parts, "\x1f")
+	}
+}
+
+// ShardBy splits in into n channels, sending every record with the same key
+// to the same channel. Unlike fanOut, records sharing a key therefore reach
+// their worker in the order they arrived, while different keys still run in
+// parallel. All outputs are closed when in is closed or ctx is done.
+func ShardBy(ctx context.Context, in <-chan []string, n int, keyFn func([]string) string) []<-chan []string {
+	if n < 1 {
+		n = 1
+	}
+
+	ring := newHashRing(n)
+	outs := make([]chan []string, n)
+	result := make([]<-chan []string, n)
+	for i := range outs {
+		outs[i] = make(chan []string)
+		result[i] = outs[i]
+	}
+
+	go func() {
+		defer func() {
+			for _, out := range outs {
+				close(out)
+			}
+		}()
+
+		for record := range in {
+			select {
+			case outs[ring.shard(keyFn(record))] <- record:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return result
+}
+
+// ShardPool is ShardBy with the workers attached, so the number of shards can
+// change while records are flowing.
+type ShardPool struct {
+	resize chan shardResize
+	done   chan struct{}
+}
+
+type shardResize struct {
+	n    int
+	done chan struct{}
+}
+
+// NewShardPool runs work for every record of in on one of n goroutines chosen
+// by the record's key.
+func NewShardPool(ctx context.Context, in <-chan []string, n int, keyFn func([]string) string, work func(shard int, record []string)) *ShardPool {
+	if n < 1 {
+		n = 1
+	}
+
+	p := &ShardPool{
+		resize: make(chan shardResize),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(p.done)
+
+		var (
+			ring   *hashRing
+			shards []chan []string
+			wg     sync.WaitGroup
+		)
+
+		start := func(n int) {
+			ring = newHashRing(n)
+			shards = make([]chan []string, n)
+			for i := range shards {
+				shards[i] = make(chan []string)
+				wg.Add(1)
+				go func(i int, c <-chan []string) {
+					defer wg.Done()
+					for record := range c {
+						work(i, record)
+					}
+				}(i, shards[i])
+			}
+		}
+
+		stop := func() {
+			for _, c := range shards {
+				close(c)
+			}
+			wg.Wait()
+		}
+
+		start(n)
+		defer stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case r := <-p.resize:
+				// Every worker finishes what it was handed before the new
+				// layout starts, so a key that moves shard can't overtake its
+				// own earlier records.
+				stop()
+				start(r.n)
+				close(r.done)
+
+			case record, ok := <-in:
+				if !ok {
+					return
+				}
+				select {
+				case shards[ring.shard(keyFn(record))] <- record:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return p
+}
+
+// Resize changes the number of shards. It returns once records are being
+// routed to the new shards, or immediately if the pool has finished.
+func (p *ShardPool) Resize(n int) {
+	if n < 1 {
+		n = 1
+	}
+
+	r := shardResize{n: n, done: make(chan struct{})}
+	select {
+	case p.resize <- r:
+		<-r.done
+	case <-p.done:
+	}
+}
+
+// Done is closed once every record has been processed, or ctx is done.
+func (p *ShardPool) Done() <-chan struct{} {
+	return p.done
+}
+
+// shardExample processes combo.csv on three shards keyed by the first letter
+// of the first column, then again after growing to four shards.
+func shardExample() {
+	firstLetter := func(record []string) string {
+		return record[0][:1]
+	}
+
+	ch, err := read("combo.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := context.Background()
+	shards := ShardBy(ctx, ch, 3, firstLetter)
+
+	// Every shard needs its own reader, the router blocks on whichever shard
+	// the next record belongs to.
+	var wg sync.WaitGroup
+	wg.Add(len(shards))
+	for i, shard := range shards {
+		go func(i int, shard <-chan []string) {
+			defer wg.Done()
+			for record := range shard {
+				fmt.Println(i, record)
+			}
+		}(i, shard)
+	}
+	wg.Wait()
+
+	ch, err = read("combo.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	pool := NewShardPool(ctx, ch, 3, firstLetter, func(shard int, record []string) {
+		fmt.Println("shard", shard, record)
+	})
+	pool.Resize(4)
+	<-pool.Done()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type recordFormat int
+
+const (
+	formatCSV recordFormat = iota
+	formatTSV
+	formatJSONLines
+)
+
+func (f recordFormat) String() string {
+	switch f {
+	case formatCSV:
+		return "csv"
+	case formatTSV:
+		return "tsv"
+	case formatJSONLines:
+		return "jsonl"
+	}
+	return fmt.Sprintf("format(%d)", int(f))
+}
+
+type sinkOptions struct {
+	Format recordFormat
+
+	// Header is written as the first row of CSV and TSV output. For JSON
+	// Lines it names the fields, so each record is written as an object;
+	// without it records are written as arrays.
+	Header []string
+
+	// Gzip compresses the output. The file name is used as given.
+	Gzip bool
+
+	// BufferSize is the size of the write buffer, 64KB by default.
+	BufferSize int
+}
+
+// recordEncoder writes records in one of the recordFormats.
+type recordEncoder interface {
+	Write(record []string) error
+	Flush() error
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (e csvEncoder) Write(record []string) error { return e.w.Write(record) }
+
+func (e csvEncoder) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type jsonLinesEncoder struct {
+	w      *bufio.Writer
+	header []string
+}
+
+func (e jsonLinesEncoder) Write(record []string) error {
+	var line []byte
+	if e.header == nil {
+		var err error
+		if line, err = json.Marshal(record); err != nil {
+			return err
+		}
+	} else {
+		// Built by hand so the fields keep the header's order.
+		line = append(line, '{')
+		for i, name := range e.header {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			key, _ := json.Marshal(name)
+			value := []byte("null")
+			if i < len(record) {
+				value, _ = json.Marshal(record[i])
+			}
+			line = append(line, key...)
+			line = append(line, ':')
+			line = append(line, value...)
+		}
+		line = append(line, '}')
+	}
+
+	line = append(line, '\n')
+	_, err := e.w.Write(line)
+	return err
+}
+
+func (e jsonLinesEncoder) Flush() error { return e.w.Flush() }
+
+func newRecordEncoder(w io.Writer, opts sinkOptions) recordEncoder {
+	switch opts.Format {
+	case formatJSONLines:
+		bw, ok := w.(*bufio.Writer)
+		if !ok {
+			bw = bufio.NewWriter(w)
+		}
+		return jsonLinesEncoder{w: bw, header: opts.Header}
+	case formatTSV:
+		cw := csv.NewWriter(w)
+		cw.Comma = '\t'
+		return csvEncoder{cw}
+	default:
+		return csvEncoder{csv.NewWriter(w)}
+	}
+}
+
+// atomicFile is written under a temporary name next to its final path and
+// only renamed into place by Commit, so readers never see a partial file.
+type atomicFile struct {
+	*os.File
+	path string
+}
+
+func createAtomic(path string) (*atomicFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating output file: %w", err)
+	}
+	return &atomicFile{File: f, path: path}, nil
+}
+
+// Commit flushes the file to disk and moves it to its final path.
+func (a *atomicFile) Commit() error {
+	if err := a.Sync(); err != nil {
+		a.Abort()
+		return fmt.Errorf("syncing output file: %w", err)
+	}
+	if err := a.Close(); err != nil {
+		os.Remove(a.Name())
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	if err := os.Chmod(a.Name(), 0o644); err != nil {
+		os.Remove(a.Name())
+		return fmt.Errorf("output file permissions: %w", err)
+	}
+	if err := os.Rename(a.Name(), a.path); err != nil {
+		os.Remove(a.Name())
+		return fmt.Errorf("renaming output file: %w", err)
+	}
+	return nil
+}
+
+// Abort throws the file away.
+func (a *atomicFile) Abort() {
+	a.Close()
+	os.Remove(a.Name())
+}
+
+// recordFileWriter writes records to a file atomically, buffered and
+// optionally gzipped.
+type recordFileWriter struct {
+	file  *atomicFile
+	buf   *bufio.Writer
+	gz    *gzip.Writer
+	enc   recordEncoder
+	size  countingWriter
+	count int64
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func createRecordFile(path string, opts sinkOptions) (*recordFileWriter, error) {
+	af, err := createAtomic(path)
+	if err != nil {
+		return nil, err
+	}
+
+	size := opts.BufferSize
+	if size <= 0 {
+		size = 64 << 10
+	}
+
+	w := &recordFileWriter{file: af, buf: bufio.NewWriterSize(af, size)}
+	var dst io.Writer = w.buf
+	if opts.Gzip {
+		w.gz = gzip.NewWriter(w.buf)
+		dst = w.gz
+	}
+	w.size.w = dst
+	w.enc = newRecordEncoder(&w.size, opts)
+
+	if opts.Header != nil && opts.Format != formatJSONLines {
+		if err := w.enc.Write(opts.Header); err != nil {
+			af.Abort()
+			return nil, fmt.Errorf("writing header: %w", err)
+		}
+	}
+	return w, nil
+}
+
+func (w *recordFileWriter) Write(record []string) error {
+	if err := w.enc.Write(record); err != nil {
+		return fmt.Errorf("writing record: %w", err)
+	}
+	w.count++
+	return nil
+}
+
+// Count returns how many records have been written, not counting a header.
+func (w *recordFileWriter) Count() int64 {
+	return w.count
+}
+
+// Size returns roughly how many bytes have been written, before
+// compression. Records still in the encoder's buffer are not counted.
+func (w *recordFileWriter) Size() int64 {
+	return w.size.n
+}
+
+// Commit flushes everything and moves the file into place.
+func (w *recordFileWriter) Commit() error {
+	if err := w.enc.Flush(); err != nil {
+		w.file.Abort()
+		return fmt.Errorf("writing output file: %w", err)
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.file.Abort()
+			return fmt.Errorf("writing output file: %w", err)
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		w.file.Abort()
+		return fmt.Errorf("writing output file: %w", err)
+	}
+	return w.file.Commit()
+}
+
+// Abort discards the file.
+func (w *recordFileWriter) Abort() {
+	w.file.Abort()
+}
+
+// writeRecords is a sink stage: it writes every record of in to path and
+// returns how many it wrote. The file only appears at path once in is
+// closed and everything was written; if ctx ends first or a write fails
+// nothing is left behind. On a write error the rest of in is drained so the
+// stages before the sink can finish.
+func writeRecords(ctx context.Context, in <-chan []string, path string, opts sinkOptions) (int64, error) {
+	w, err := createRecordFile(path, opts)
+	if err != nil {
+		for range in {
+		}
+		return 0, err
+	}
+
+	for {
+		select {
+		case record, ok := <-in:
+			if !ok {
+				if err := w.Commit(); err != nil {
+					return 0, err
+				}
+				return w.Count(), nil
+			}
+			if err := w.Write(record); err != nil {
+				w.Abort()
+				for range in {
+				}
+				return 0, err
+			}
+		case <-ctx.Done():
+			w.Abort()
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// sinkExample writes the sanitized pipeline.csv as gzipped JSON Lines.
+func sinkExample() {
+	ch, err := readCSV("pipeline.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	n, err := writeRecords(context.Background(), titleCase(sanitize(ch)), "pipeline.jsonl.gz", sinkOptions{
+		Format: formatJSONLines,
+		Header: []string{"first", "second", "third"},
+		Gzip:   true,
+	})
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("wrote", n, "records to pipeline.jsonl.gz")
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+)
+
+// reservoir keeps a uniform random sample of k values from a stream of
+// unknown length (Algorithm R).
+type reservoir struct {
+	k      int
+	n      int64
+	sample []string
+	rng    *rand.Rand
+}
+
+func newReservoir(k int, seed int64) *reservoir {
+	return &reservoir{k: k, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (r *reservoir) add(v string) {
+	r.n++
+	if len(r.sample) < r.k {
+		r.sample = append(r.sample, v)
+		return
+	}
+	if i := r.rng.Int63n(r.n); i < int64(r.k) {
+		r.sample[i] = v
+	}
+}
+
+// hyperLogLog estimates the number of distinct values with 2^precision one
+// byte registers, to within about 1.04/sqrt(2^precision).
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{precision: precision, registers: make([]uint8, 1<<precision)}
+}
+
+func (h *hyperLogLog) add(v string) {
+	x := hashKey(v)
+	i := x >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1))) + 1
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+
+	alpha := 0.7213 / (1 + 1.079/m)
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Small cardinalities are counted more accurately from the empty
+		// registers (linear counting).
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(e + 0.5)
+}
+
+// countMinSketch estimates how often each value occurred, never
+// underestimating, and tracks the k values with the highest estimates.
+type countMinSketch struct {
+	width  uint64
+	counts [][]uint64
+	k      int
+	top    map[string]uint64
+}
+
+func newCountMinSketch(depth, width, k int) *countMinSketch {
+	counts := make([][]uint64, depth)
+	for i := range counts {
+		counts[i] = make([]uint64, width)
+	}
+	return &countMinSketch{width: uint64(width), counts: counts, k: k, top: make(map[string]uint64)}
+}
+
+func (c *countMinSketch) add(v string) {
+	h := hashKey(v)
+	h1, h2 := h&0xffffffff, h>>32|1
+
+	estimate := uint64(math.MaxUint64)
+	for i, row := range c.counts {
+		j := (h1 + uint64(i)*h2) % c.width
+		row[j]++
+		if row[j] < estimate {
+			estimate = row[j]
+		}
+	}
+
+	if _, ok := c.top[v]; ok || len(c.top) < c.k {
+		c.top[v] = estimate
+		return
+	}
+
+	// Replace the weakest candidate if v now beats it.
+	weakest, min := "", uint64(math.MaxUint64)
+	for key, n := range c.top {
+		if n < min {
+			weakest, min = key, n
+		}
+	}
+	if estimate > min {
+		delete(c.top, weakest)
+		c.top[v] = estimate
+	}
+}
+
+type heavyHitter struct {
+	Value string
+	Count uint64
+}
+
+func (c *countMinSketch) topK() []heavyHitter {
+	hitters := make([]heavyHitter, 0, len(c.top))
+	for v, n := range c.top {
+		hitters = append(hitters, heavyHitter{v, n})
+	}
+	sort.Slice(hitters, func(i, j int) bool {
+		if hitters[i].Count != hitters[j].Count {
+			return hitters[i].Count > hitters[j].Count
+		}
+		return hitters[i].Value < hitters[j].Value
+	})
+	return hitters
+}
+
+type centroid struct {
+	mean, weight float64
+}
+
+// tDigest estimates quantiles of a stream of numbers. Values are clustered
+// into centroids that are small near the tails and larger near the median,
+// so extreme quantiles stay accurate with little memory.
+type tDigest struct {
+	compression float64
+	centroids   []centroid
+	buffer      []float64
+	count       float64
+	min, max    float64
+}
+
+func newTDigest(compression float64) *tDigest {
+	return &tDigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+func (t *tDigest) add(x float64) {
+	t.buffer = append(t.buffer, x)
+	t.min = math.Min(t.min, x)
+	t.max = math.Max(t.max, x)
+	if len(t.buffer) >= int(t.compression)*5 {
+		t.compress()
+	}
+}
+
+// scale is the k1 scale function: it limits a centroid to covering one unit
+// of k, which is narrow in q near 0 and 1.
+func (t *tDigest) scale(q float64) float64 {
+	return t.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (t *tDigest) compress() {
+	if len(t.buffer) == 0 {
+		return
+	}
+
+	all := t.centroids
+	for _, x := range t.buffer {
+		all = append(all, centroid{mean: x, weight: 1})
+		t.count++
+	}
+	t.buffer = t.buffer[:0]
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+
+	merged := make([]centroid, 0, len(all))
+	cur := all[0]
+	seen := 0.0
+	kLow := t.scale(0)
+	for _, c := range all[1:] {
+		q := (seen + cur.weight + c.weight) / t.count
+		if t.scale(q)-kLow <= 1 {
+			cur.mean += (c.mean - cur.mean) * c.weight / (cur.weight + c.weight)
+			cur.weight += c.weight
+			continue
+		}
+		seen += cur.weight
+		merged = append(merged, cur)
+		kLow = t.scale(seen / t.count)
+		cur = c
+	}
+	t.centroids = append(merged, cur)
+}
+
+// quantile returns the estimated value at quantile q, NaN for no data.
+func (t *tDigest) quantile(q float64) float64 {
+	t.compress()
+	if t.count == 0 {
+		return math.NaN()
+	}
+	if q <= 0 {
+		return t.min
+	}
+	if q >= 1 {
+		return t.max
+	}
+
+	target := q * t.count
+	seen := 0.0
+	for i, c := range t.centroids {
+		// Each centroid's mean sits at the middle of its weight.
+		mid := seen + c.weight/2
+		if target < mid {
+			if i == 0 {
+				return t.min + (c.mean-t.min)*target/mid
+			}
+			prev := t.centroids[i-1]
+			prevMid := seen - prev.weight/2
+			return prev.mean + (c.mean-prev.mean)*(target-prevMid)/(mid-prevMid)
+		}
+		seen += c.weight
+	}
+
+	last := t.centroids[len(t.centroids)-1]
+	lastMid := t.count - last.weight/2
+	return last.mean + (t.max-last.mean)*(target-lastMid)/(t.count-lastMid)
+}
+
+type profileOptions struct {
+	// Names labels the columns in the report, by index.
+	Names []string
+
+	SampleSize int // values kept per column, defaults to 5
+	TopK       int // heavy hitters per column, defaults to 5
+
+	// ReportTo receives the report once in is closed; nil means os.Stdout.
+	ReportTo io.Writer
+}
+
+type columnProfile struct {
+	values    int64
+	sample    *reservoir
+	distinct  *hyperLogLog
+	frequent  *countMinSketch
+	quantiles *tDigest
+}
+
+// streamProfile is the running profile of a record stream. It is safe to
+// query while records are still flowing.
+type streamProfile struct {
+	mu      sync.Mutex
+	opts    profileOptions
+	rows    int64
+	columns []*columnProfile
+}
+
+func (p *streamProfile) add(record []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.rows++
+	for len(p.columns) < len(record) {
+		p.columns = append(p.columns, &columnProfile{
+			sample:    newReservoir(p.opts.SampleSize, int64(len(p.columns))),
+			distinct:  newHyperLogLog(12),
+			frequent:  newCountMinSketch(4, 2048, p.opts.TopK),
+			quantiles: newTDigest(100),
+		})
+	}
+
+	for i, v := range record {
+		c := p.columns[i]
+		c.values++
+		c.sample.add(v)
+		c.distinct.add(v)
+		c.frequent.add(v)
+		if x, err := strconv.ParseFloat(v, 64); err == nil {
+			c.quantiles.add(x)
+		}
+	}
+}
+
+type columnReport struct {
+	Name      string
+	Values    int64
+	Distinct  uint64
+	Sample    []string
+	Top       []heavyHitter
+	Numbers   int64
+	Quantiles map[float64]float64 // p50, p90, p99 of the numeric values
+}
+
+type profileReport struct {
+	Rows    int64
+	Columns []columnReport
+}
+
+// Report returns the profile of everything seen so far.
+func (p *streamProfile) Report() profileReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	report := profileReport{Rows: p.rows}
+	for i, c := range p.columns {
+		name := "col " + strconv.Itoa(i)
+		if i < len(p.opts.Names) {
+			name = p.opts.Names[i]
+		}
+
+		cr := columnReport{
+			Name:     name,
+			Values:   c.values,
+			Distinct: c.distinct.estimate(),
+			Sample:   append([]string{}, c.sample.sample...),
+			Top:      c.frequent.topK(),
+		}
+		c.quantiles.compress()
+		if c.quantiles.count > 0 {
+			cr.Numbers = int64(c.quantiles.count)
+			cr.Quantiles = make(map[float64]float64)
+			for _, q := range []float64{0.5, 0.9, 0.99} {
+				cr.Quantiles[q] = c.quantiles.quantile(q)
+			}
+		}
+		report.Columns = append(report.Columns, cr)
+	}
+	return report
+}
+
+// WriteReport writes Report as a table.
+func (p *streamProfile) WriteReport(w io.Writer) error {
+	report := p.Report()
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "rows: %d\n", report.Rows)
+	fmt.Fprintln(tw, "column\tvalues\tdistinct\tp50\tp90\tp99\ttop\tsample")
+	for _, c := range report.Columns {
+		quantiles := "-\t-\t-"
+		if c.Numbers > 0 {
+			quantiles = fmt.Sprintf("%.4g\t%.4g\t%.4g", c.Quantiles[0.5], c.Quantiles[0.9], c.Quantiles[0.99])
+		}
+		top := make([]string, len(c.Top))
+		for i, h := range c.Top {
+			top[i] = fmt.Sprintf("%s(%d)", h.Value, h.Count)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t~%d\t%s\t%v\t%v\n", c.Name, c.Values, c.Distinct, quantiles, top, c.Sample)
+	}
+	return tw.Flush()
+}
+
+// profileTap passes every record of in through unchanged while profiling
+// each column, and writes the report to opts.ReportTo once in is closed. An
+// error writing the report is sent on the error channel.
+func profileTap(ctx context.Context, in <-chan []string, opts profileOptions) (<-chan []string, *streamProfile, <-chan error) {
+	if opts.SampleSize <= 0 {
+		opts.SampleSize = 5
+	}
+	if opts.TopK <= 0 {
+		opts.TopK = 5
+	}
+	if opts.ReportTo == nil {
+		opts.ReportTo = os.Stdout
+	}
+
+	p := &streamProfile{opts: opts}
+	out := make(chan []string)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+		for {
+			select {
+			case record, ok := <-in:
+				if !ok {
+					if err := p.WriteReport(opts.ReportTo); err != nil {
+						errc <- fmt.Errorf("writing profile report: %w", err)
+					}
+					return
+				}
+				p.add(record)
+				select {
+				case out <- record:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, p, errc
+}
+
+// profileExample profiles combo.csv alongside a column of random numbers on
+// its way through the pipeline.
+func profileExample() {
+	ch, err := read("combo.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	withNumbers := make(chan []string)
+	go func() {
+		defer close(withNumbers)
+		for record := range ch {
+			for i := 0; i < 100; i++ {
+				withNumbers <- append(record[:4:4], strconv.FormatFloat(rand.NormFloat64()*10+50, 'f', 2, 64))
+			}
+		}
+	}()
+
+	tapped, _, errc := profileTap(context.Background(), withNumbers, profileOptions{})
+	for range tapped {
+	}
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type sourceOptions struct {
+	// Comma reads the file as delimited text with this separator, whatever
+	// its name says.
+	Comma rune
+
+	// Widths reads the file as fixed-width text, each column being the
+	// given number of bytes. Trailing spaces are trimmed from every field.
+	Widths []int
+
+	// Fields picks the fields of JSON Lines objects, in this order. Without
+	// it the keys of the first object are used.
+	Fields []string
+}
+
+// recordDecoder reads records one at a time and returns io.EOF after the
+// last one.
+type recordDecoder interface {
+	Read() ([]string, error)
+}
+
+type csvDecoder struct {
+	r *csv.Reader
+}
+
+func (d csvDecoder) Read() ([]string, error) {
+	record, err := d.r.Read()
+	// Rows of the wrong length are still passed on, as readWithHeader does;
+	// stages that care can check.
+	if errors.Is(err, csv.ErrFieldCount) {
+		err = nil
+	}
+	return record, err
+}
+
+// jsonLinesDecoder reads one JSON value per line. Arrays are taken as the
+// record; objects are turned into one by field name. Strings are used as
+// they are, null becomes "" and anything else its JSON text.
+type jsonLinesDecoder struct {
+	s      *bufio.Scanner
+	fields []string
+	index  map[string]int
+	line   int
+}
+
+func (d *jsonLinesDecoder) Read() ([]string, error) {
+	for d.s.Scan() {
+		d.line++
+		line := bytes.TrimSpace(d.s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		record, err := d.decode(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", d.line, err)
+		}
+		return record, nil
+	}
+	if err := d.s.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+func (d *jsonLinesDecoder) decode(line []byte) ([]string, error) {
+	if line[0] == '[' {
+		var values []json.RawMessage
+		if err := json.Unmarshal(line, &values); err != nil {
+			return nil, err
+		}
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = jsonField(v)
+		}
+		return record, nil
+	}
+
+	// Walk the object with a Decoder so its keys come in file order.
+	dec := json.NewDecoder(bytes.NewReader(line))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, fmt.Errorf("want a JSON array or object")
+	}
+
+	var keys []string
+	var values []json.RawMessage
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		keys = append(keys, t.(string))
+		values = append(values, v)
+	}
+
+	if d.index == nil {
+		if d.fields == nil {
+			d.fields = keys
+		}
+		d.index = make(map[string]int, len(d.fields))
+		for i, f := range d.fields {
+			d.index[f] = i
+		}
+	}
+
+	record := make([]string, len(d.fields))
+	for i, k := range keys {
+		if c, ok := d.index[k]; ok {
+			record[c] = jsonField(values[i])
+		}
+	}
+	return record, nil
+}
+
+func jsonField(v json.RawMessage) string {
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return s
+	}
+	if string(v) == "null" {
+		return ""
+	}
+	return string(v)
+}
+
+type fixedWidthDecoder struct {
+	s      *bufio.Scanner
+	widths []int
+}
+
+func (d fixedWidthDecoder) Read() ([]string, error) {
+	if !d.s.Scan() {
+		if err := d.s.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	line := strings.TrimRight(d.s.Text(), "\r")
+	record := make([]string, len(d.widths))
+	pos := 0
+	for i, w := range d.widths {
+		if pos >= len(line) {
+			break
+		}
+		end := pos + w
+		if end > len(line) {
+			end = len(line)
+		}
+		record[i] = strings.TrimRight(line[pos:end], " ")
+		pos = end
+	}
+	return record, nil
+}
+
+// newRecordDecoder reads format, unless opts.Widths is set, which means
+// fixed-width text whatever format says.
+func newRecordDecoder(r io.Reader, format recordFormat, opts sourceOptions) recordDecoder {
+	if opts.Widths != nil {
+		return fixedWidthDecoder{s: bufio.NewScanner(r), widths: opts.Widths}
+	}
+
+	switch format {
+	case formatJSONLines:
+		s := bufio.NewScanner(r)
+		s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		return &jsonLinesDecoder{s: s, fields: opts.Fields}
+	}
+
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	switch {
+	case opts.Comma != 0:
+		cr.Comma = opts.Comma
+	case format == formatTSV:
+		cr.Comma = '\t'
+		cr.LazyQuotes = true
+	}
+	return csvDecoder{cr}
+}
+
+// decompress unwraps r if it starts with the gzip or bzip2 magic bytes.
+func decompress(r *bufio.Reader) (io.Reader, error) {
+	magic, _ := r.Peek(3)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("reading gzip: %w", err)
+		}
+		return gz, nil
+	case bytes.Equal(magic, []byte("BZh")):
+		return bzip2.NewReader(r), nil
+	}
+	return r, nil
+}
+
+// detectFormat picks the format from the file name, ignoring a compression
+// extension, and failing that from the first line of content.
+func detectFormat(name string, head []byte) recordFormat {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".gz", ".gzip", ".bz2"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	switch filepath.Ext(name) {
+	case ".csv":
+		return formatCSV
+	case ".tsv", ".tab":
+		return formatTSV
+	case ".jsonl", ".ndjson", ".json":
+		return formatJSONLines
+	}
+
+	head = bytes.TrimLeft(head, " \t\r\n")
+	if len(head) > 0 && (head[0] == '{' || head[0] == '[') {
+		return formatJSONLines
+	}
+	if i := bytes.IndexByte(head, '\n'); i >= 0 {
+		head = head[:i]
+	}
+	if bytes.Count(head, []byte{'\t'}) > bytes.Count(head, []byte{','}) {
+		return formatTSV
+	}
+	return formatCSV
+}
+
+// readSource is read for any of the supported formats: CSV, TSV or another
+// delimiter, JSON Lines and fixed-width text, each optionally gzip or bzip2
+// compressed. Compression is recognised by its magic bytes; the format comes
+// from opts if Comma or Widths are set, else from the file extension, else
+// from the content.
+//
+// The records are the same []string every other stage takes. Reading stops
+// at the first error, which is sent on the error channel.
+func readSource(ctx context.Context, filename string, opts sourceOptions) (<-chan []string, <-chan error) {
+	out := make(chan []string)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+		defer close(out)
+
+		f, err := os.Open(filename)
+		if err != nil {
+			errc <- fmt.Errorf("opening file: %w", err)
+			return
+		}
+		defer f.Close()
+
+		r, err := decompress(bufio.NewReader(f))
+		if err != nil {
+			errc <- err
+			return
+		}
+		if c, ok := r.(io.Closer); ok {
+			defer c.Close()
+		}
+
+		br := bufio.NewReader(r)
+		format := formatCSV
+		if opts.Widths == nil && opts.Comma == 0 {
+			head, _ := br.Peek(4096)
+			format = detectFormat(filename, head)
+		}
+
+		dec := newRecordDecoder(br, format, opts)
+		for {
+			record, err := dec.Read()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				errc <- fmt.Errorf("reading %s: %w", filename, err)
+				return
+			}
+
+			select {
+			case out <- record:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+
+	return out, errc
+}
+
+// sourceExample writes pipeline.csv out as gzipped JSON Lines and reads it
+// back through the same stages as the CSV.
+func sourceExample() {
+	ctx := context.Background()
+
+	ch, err := readCSV("pipeline.csv")
+	if err != nil {
+		panic(err)
+	}
+	if _, err := writeRecords(ctx, ch, "pipeline.jsonl.gz", sinkOptions{Format: formatJSONLines, Gzip: true}); err != nil {
+		panic(err)
+	}
+
+	records, errc := readSource(ctx, "pipeline.jsonl.gz", sourceOptions{})
+	for v := range titleCase(sanitize(records)) {
+		fmt.Println(v)
+	}
+	if err := <-errc; err != nil {
+		panic(err)
+	}
+}
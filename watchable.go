@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Versioned is a value together with the version Set assigned to it.
+type Versioned[T any] struct {
+	Value   T
+	Version uint64
+}
+
+// Watchable holds a single value and publishes every change to it. Each Set
+// bumps a version number, so a watcher that remembers the last version it saw
+// can always tell whether it has missed something, unlike the map+Cond pairing
+// in differentCondExample where a Broadcast before a listener waits is gone.
+type Watchable[T any] struct {
+	mu      sync.Mutex
+	value   T
+	version uint64
+	changed chan struct{} // closed and replaced on every Set
+	subs    map[*watchSubscriber[T]]struct{}
+}
+
+type watchSubscriber[T any] struct {
+	pending []Versioned[T]
+	notify  chan struct{}
+}
+
+// NewWatchable returns a Watchable holding initial at version 0.
+func NewWatchable[T any](initial T) *Watchable[T] {
+	return &Watchable[T]{
+		value:   initial,
+		changed: make(chan struct{}),
+		subs:    make(map[*watchSubscriber[T]]struct{}),
+	}
+}
+
+// Set stores v and returns its version.
+func (w *Watchable[T]) Set(v T) uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.value = v
+	w.version++
+
+	close(w.changed)
+	w.changed = make(chan struct{})
+
+	for s := range w.subs {
+		s.pending = append(s.pending, Versioned[T]{Value: v, Version: w.version})
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+	}
+
+	return w.version
+}
+
+// Get returns the current value and its version.
+func (w *Watchable[T]) Get() (T, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.value, w.version
+}
+
+// Watch blocks until the version differs from lastVersion and returns the
+// current value and version. Passing the version from a previous Get or Watch
+// means a change made in between is never missed; intermediate values may be
+// skipped if several Sets happen before the watcher gets to run. Use Subscribe
+// to see every value.
+func (w *Watchable[T]) Watch(ctx context.Context, lastVersion uint64) (T, uint64, error) {
+	for {
+		w.mu.Lock()
+		value, version, changed := w.value, w.version, w.changed
+		w.mu.Unlock()
+
+		if version != lastVersion {
+			return value, version, nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			var zero T
+			return zero, lastVersion, ctx.Err()
+		}
+	}
+}
+
+// Subscribe returns a stream that starts with the current value and then
+// receives every later value in order. Changes are queued for the subscriber
+// rather than dropped, so a slow reader costs memory instead of updates. The
+// stream is closed once ctx is done.
+func (w *Watchable[T]) Subscribe(ctx context.Context) <-chan Versioned[T] {
+	out := make(chan Versioned[T])
+	s := &watchSubscriber[T]{notify: make(chan struct{}, 1)}
+
+	w.mu.Lock()
+	s.pending = append(s.pending, Versioned[T]{Value: w.value, Version: w.version})
+	w.subs[s] = struct{}{}
+	w.mu.Unlock()
+
+	go func() {
+		defer close(out)
+		defer func() {
+			w.mu.Lock()
+			delete(w.subs, s)
+			w.mu.Unlock()
+		}()
+
+		for {
+			w.mu.Lock()
+			batch := s.pending
+			s.pending = nil
+			w.mu.Unlock()
+
+			for _, v := range batch {
+				select {
+				case out <- v:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-s.notify:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// watchableExample is differentCondExample rewritten around a Watchable. The
+// broadcast may happen before either listener starts, and neither one misses it.
+func watchableExample() {
+	age := NewWatchable(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	// listener 1 waits for the first change after version 0
+	go func() {
+		defer wg.Done()
+		v, version, err := age.Watch(ctx, 0)
+		if err != nil {
+			fmt.Println("lis1 gave up:", err)
+			return
+		}
+		fmt.Println("lis1  age:", v, "version:", version)
+	}()
+
+	// listener 2 follows every change
+	go func() {
+		defer wg.Done()
+		for v := range age.Subscribe(ctx) {
+			fmt.Println("lis2  age:", v.Value, "version:", v.Version)
+			if v.Version == 2 {
+				return
+			}
+		}
+	}()
+
+	// broadcast
+	age.Set(25)
+	time.Sleep(time.Second)
+	age.Set(26)
+
+	wg.Wait()
+}
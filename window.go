@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type windowKind int
+
+const (
+	// tumblingWindow splits time into back to back windows of Size.
+	tumblingWindow windowKind = iota
+	// slidingWindow starts a window of Size every Slide, so windows overlap
+	// and a record can belong to several.
+	slidingWindow
+	// sessionWindow groups records that are less than Gap apart. Sessions
+	// cover the whole stream, GroupBy only splits the aggregates within one.
+	sessionWindow
+)
+
+type windowOptions struct {
+	Kind windowKind
+
+	// Size is the length of tumbling and sliding windows, Slide how far
+	// apart sliding windows start, Size by default, and Gap the silence
+	// that ends a session. Each must be positive for the kinds that use it.
+	Size  time.Duration
+	Slide time.Duration
+	Gap   time.Duration
+
+	// EventTime reads the time of a record. When nil records are stamped
+	// with the time they arrive (processing time). Records it fails on are
+	// dropped and counted as malformed.
+	EventTime func([]string) (time.Time, error)
+
+	// MaxOutOfOrder is how far behind the newest event time a record may be
+	// and still be on time. The watermark trails the newest event time by
+	// this much; a window is emitted once the watermark passes its end.
+	MaxOutOfOrder time.Duration
+
+	// AllowedLateness keeps a window open for this long after it has been
+	// emitted. A record that arrives in that time updates the window and it
+	// is emitted again with Update set; anything later is dropped.
+	AllowedLateness time.Duration
+
+	// Tick is how often the watermark is advanced with processing time when
+	// no records arrive. Defaults to a quarter of the window size.
+	Tick time.Duration
+
+	GroupBy []int
+	Aggs    []aggSpec
+}
+
+// windowResult is the aggregate of one window: a record per group, laid out
+// like the output of aggregate.
+type windowResult struct {
+	Start, End time.Time
+	Records    [][]string
+	Update     bool
+}
+
+func (r windowResult) String() string {
+	rows := make([]string, len(r.Records))
+	for i, record := range r.Records {
+		rows[i] = strings.Join(record, ",")
+	}
+	update := ""
+	if r.Update {
+		update = " (update)"
+	}
+	return fmt.Sprintf("[%s, %s)%s %v", r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339), update, rows)
+}
+
+// windowStats counts records a window stage could not use.
+type windowStats struct {
+	late      uint64
+	malformed uint64
+}
+
+// Late returns how many records arrived after their windows were closed.
+func (s *windowStats) Late() uint64 { return atomic.LoadUint64(&s.late) }
+
+// Malformed returns how many records had no usable event time.
+func (s *windowStats) Malformed() uint64 { return atomic.LoadUint64(&s.malformed) }
+
+type windowState struct {
+	start, end time.Time
+	table      *aggTable
+	fired      bool
+	dirty      bool // changed since it was last emitted
+}
+
+func (o windowOptions) validate() error {
+	switch o.Kind {
+	case tumblingWindow, slidingWindow:
+		if o.Size <= 0 {
+			return fmt.Errorf("window size must be positive, not %v", o.Size)
+		}
+		if o.Slide < 0 {
+			return fmt.Errorf("window slide must be positive, not %v", o.Slide)
+		}
+	case sessionWindow:
+		if o.Gap <= 0 {
+			return fmt.Errorf("session gap must be positive, not %v", o.Gap)
+		}
+	default:
+		return fmt.Errorf("unknown window kind %d", o.Kind)
+	}
+	return nil
+}
+
+// window aggregates the records of in over time windows. Every window that
+// is still open when in closes is emitted at the end. Invalid options are
+// returned as an error straight away, and in is left unread.
+func window(ctx context.Context, in <-chan []string, opts windowOptions) (<-chan windowResult, *windowStats, error) {
+	if err := opts.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	out := make(chan windowResult)
+	stats := &windowStats{}
+
+	tick := opts.Tick
+	if tick <= 0 {
+		tick = opts.Size
+		if opts.Kind == sessionWindow {
+			tick = opts.Gap
+		}
+		tick /= 4
+		if tick < 10*time.Millisecond {
+			tick = 10 * time.Millisecond
+		}
+	}
+	if opts.Kind == slidingWindow && opts.Slide == 0 {
+		opts.Slide = opts.Size
+	}
+
+	go func() {
+		defer close(out)
+
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		var (
+			windows   []*windowState
+			watermark time.Time
+			newest    time.Time
+		)
+
+		closed := func(w *windowState) bool {
+			return !watermark.IsZero() && !w.end.Add(opts.AllowedLateness).After(watermark)
+		}
+
+		emit := func(w *windowState) bool {
+			result := windowResult{Start: w.start, End: w.end, Records: w.table.records(), Update: w.fired}
+			w.fired, w.dirty = true, false
+			select {
+			case out <- result:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		// advance emits every window the watermark has passed, re-emits the
+		// ones late records have changed and forgets those past their
+		// lateness. With flush set everything still held is emitted.
+		advance := func(flush bool) bool {
+			sort.Slice(windows, func(i, j int) bool { return windows[i].end.Before(windows[j].end) })
+
+			kept := windows[:0]
+			for _, w := range windows {
+				due := flush || (!watermark.IsZero() && !w.end.After(watermark))
+				if due && (!w.fired || w.dirty) {
+					if !emit(w) {
+						return false
+					}
+				}
+				if !flush && !closed(w) {
+					kept = append(kept, w)
+				}
+			}
+			windows = kept
+			return true
+		}
+
+		open := func(start, end time.Time) *windowState {
+			for _, w := range windows {
+				if w.start.Equal(start) && w.end.Equal(end) {
+					return w
+				}
+			}
+			w := &windowState{start: start, end: end, table: newAggTable(opts.GroupBy, opts.Aggs)}
+			windows = append(windows, w)
+			return w
+		}
+
+		add := func(t time.Time, record []string) {
+			var targets []*windowState
+
+			switch opts.Kind {
+			case tumblingWindow:
+				start := t.Truncate(opts.Size)
+				targets = append(targets, &windowState{start: start, end: start.Add(opts.Size)})
+
+			case slidingWindow:
+				last := t.Truncate(opts.Slide)
+				for start := last; start.Add(opts.Size).After(t); start = start.Add(-opts.Slide) {
+					targets = append(targets, &windowState{start: start, end: start.Add(opts.Size)})
+				}
+
+			case sessionWindow:
+				session := &windowState{start: t, end: t.Add(opts.Gap), table: newAggTable(opts.GroupBy, opts.Aggs)}
+				if closed(session) {
+					atomic.AddUint64(&stats.late, 1)
+					return
+				}
+
+				// Fold every session this record touches into one.
+				kept := windows[:0]
+				for _, w := range windows {
+					if w.start.After(session.end) || session.start.After(w.end) || closed(w) {
+						kept = append(kept, w)
+						continue
+					}
+					if w.start.Before(session.start) {
+						session.start = w.start
+					}
+					if w.end.After(session.end) {
+						session.end = w.end
+					}
+					session.table.merge(w.table)
+					session.fired = session.fired || w.fired
+				}
+				windows = append(kept, session)
+				session.table.add(record)
+				session.dirty = true
+				return
+			}
+
+			added := false
+			for _, target := range targets {
+				if closed(target) {
+					continue
+				}
+				w := open(target.start, target.end)
+				w.table.add(record)
+				w.dirty = true
+				added = true
+			}
+			if !added {
+				atomic.AddUint64(&stats.late, 1)
+			}
+		}
+
+		for {
+			select {
+			case record, ok := <-in:
+				if !ok {
+					advance(true)
+					return
+				}
+
+				t := time.Now()
+				if opts.EventTime != nil {
+					var err error
+					if t, err = opts.EventTime(record); err != nil {
+						atomic.AddUint64(&stats.malformed, 1)
+						continue
+					}
+					if t.After(newest) {
+						newest = t
+						watermark = newest.Add(-opts.MaxOutOfOrder)
+					}
+				}
+
+				add(t, record)
+				if !advance(false) {
+					return
+				}
+
+			case now := <-ticker.C:
+				if opts.EventTime == nil {
+					watermark = now
+				}
+				if !advance(false) {
+					return
+				}
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out, stats, nil
+}
+
+// windowExample counts generatorMore's messages in tumbling three second
+// windows of processing time, for ten seconds.
+func windowExample() {
+	messages := generatorMore("tick")
+	stop := time.After(10 * time.Second)
+
+	records := make(chan []string)
+	go func() {
+		defer close(records)
+		for {
+			select {
+			case msg := <-messages:
+				records <- []string{msg}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	results, _, err := window(context.Background(), records, windowOptions{
+		Kind: tumblingWindow,
+		Size: 3 * time.Second,
+		Aggs: []aggSpec{{Func: aggCount}, {Func: aggDistinct, Col: 0}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	for r := range results {
+		fmt.Println(r)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrPoolClosed = errors.New("worker pool is shut down")
+
+// WorkerPool runs submitted tasks on a set of goroutines whose size can be
+// changed while it is running.
+type WorkerPool struct {
+	// mu guards closed and the tasks channel against Submit racing Shutdown.
+	// Submit holds the read lock while it queues, so tasks is never closed
+	// under a sender.
+	mu     sync.RWMutex
+	closed bool
+	tasks  chan func()
+
+	workersMu    sync.Mutex
+	workers      []*poolWorker // running workers
+	all          []*poolWorker // every worker ever started, for Stats
+	shuttingDown bool
+	wg           sync.WaitGroup
+
+	shutdownOnce sync.Once
+	done         chan struct{}
+}
+
+type poolWorker struct {
+	id        int
+	quit      chan struct{}
+	processed uint64
+	busy      int64 // nanoseconds spent running tasks
+	stopped   int32
+}
+
+// WorkerStats describes the work done by a single worker.
+type WorkerStats struct {
+	ID        int
+	Processed uint64
+	Busy      time.Duration
+	Running   bool
+}
+
+// NewWorkerPool starts a pool with the given number of workers and a queue
+// that holds up to queue tasks before Submit blocks.
+func NewWorkerPool(workers, queue int) *WorkerPool {
+	p := &WorkerPool{
+		tasks: make(chan func(), queue),
+		done:  make(chan struct{}),
+	}
+	p.Resize(workers)
+	return p
+}
+
+// Submit queues task, blocking while the queue is full. It fails with
+// ErrPoolClosed once Shutdown has been called, or with ctx.Err() if ctx ends
+// before the task could be queued.
+func (p *WorkerPool) Submit(ctx context.Context, task func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	select {
+	case p.tasks <- task:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Resize grows or shrinks the pool to n workers. Workers that are removed
+// finish the task they are running first. Resizing to zero pauses the pool;
+// queued tasks stay queued. Resize has no effect once Shutdown was called.
+func (p *WorkerPool) Resize(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	if p.shuttingDown {
+		return
+	}
+
+	for len(p.workers) < n {
+		p.startWorker()
+	}
+
+	for len(p.workers) > n {
+		last := len(p.workers) - 1
+		close(p.workers[last].quit)
+		p.workers = p.workers[:last]
+	}
+}
+
+// Size returns the number of running workers.
+func (p *WorkerPool) Size() int {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+	return len(p.workers)
+}
+
+// startWorker must be called with workersMu held.
+func (p *WorkerPool) startWorker() {
+	w := &poolWorker{
+		id:   len(p.all) + 1,
+		quit: make(chan struct{}),
+	}
+	p.workers = append(p.workers, w)
+	p.all = append(p.all, w)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer atomic.StoreInt32(&w.stopped, 1)
+
+		for {
+			select {
+			case <-w.quit:
+				return
+			case task, ok := <-p.tasks:
+				if !ok {
+					return
+				}
+				start := time.Now()
+				task()
+				atomic.AddInt64(&w.busy, int64(time.Since(start)))
+				atomic.AddUint64(&w.processed, 1)
+			}
+		}
+	}()
+}
+
+// Shutdown stops accepting tasks and waits for the queued ones to finish. If
+// the pool had been resized to zero a worker is started to drain the queue.
+// It returns ctx.Err() if ctx ends first; the workers keep draining in the
+// background and Done is closed when they are finished.
+func (p *WorkerPool) Shutdown(ctx context.Context) error {
+	p.shutdownOnce.Do(func() {
+		p.workersMu.Lock()
+		p.shuttingDown = true
+		if len(p.workers) == 0 {
+			p.startWorker()
+		}
+		p.workersMu.Unlock()
+
+		p.mu.Lock()
+		p.closed = true
+		close(p.tasks)
+		p.mu.Unlock()
+
+		go func() {
+			p.wg.Wait()
+			close(p.done)
+		}()
+	})
+
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done is closed once the pool has shut down and every worker has exited.
+func (p *WorkerPool) Done() <-chan struct{} {
+	return p.done
+}
+
+// Stats returns per worker counters, including workers removed by Resize.
+func (p *WorkerPool) Stats() []WorkerStats {
+	p.workersMu.Lock()
+	defer p.workersMu.Unlock()
+
+	stats := make([]WorkerStats, len(p.all))
+	for i, w := range p.all {
+		stats[i] = WorkerStats{
+			ID:        w.id,
+			Processed: atomic.LoadUint64(&w.processed),
+			Busy:      time.Duration(atomic.LoadInt64(&w.busy)),
+			Running:   atomic.LoadInt32(&w.stopped) == 0,
+		}
+	}
+	return stats
+}
+
+// allClosed is a completion barrier: it returns a channel that is closed
+// once every one of chans has been closed. Anything sent on chans is
+// received and thrown away, so it is only for done channels like the ones
+// fanOut returns, whose workers print their own output. It replaces the
+// nil-channel select loop for any number of workers.
+func allClosed(chans ...<-chan struct{}) <-chan struct{} {
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(len(chans))
+	for _, c := range chans {
+		go func(c <-chan struct{}) {
+			defer wg.Done()
+			for range c {
+			}
+		}(c)
+	}
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	return done
+}
+
+// workerPoolExample prints combo.csv on a pool that starts with one worker
+// and grows to three part way through.
+func workerPoolExample() {
+	ch, err := read("combo.csv")
+	if err != nil {
+		panic(err)
+	}
+
+	pool := NewWorkerPool(1, 4)
+	ctx := context.Background()
+
+	rows := 0
+	for v := range ch {
+		v := v
+		if rows == 2 {
+			pool.Resize(3)
+		}
+		err := pool.Submit(ctx, func() {
+			time.Sleep(10 * time.Millisecond)
+			fmt.Println(v)
+		})
+		if err != nil {
+			panic(err)
+		}
+		rows++
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := pool.Shutdown(ctx); err != nil {
+		panic(err)
+	}
+
+	for _, s := range pool.Stats() {
+		fmt.Printf("worker %d processed %d in %s\n", s.ID, s.Processed, s.Busy)
+	}
+}